@@ -0,0 +1,151 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Naming layer of other exporters, see -compat. Empty for none.
+var compatMode string
+
+// Metrics of -compat=cadvisor. They carry the values of the container metrics
+// under the names of cAdvisor, with the labels of the container metrics:
+//
+//	container_cpu_usage_seconds_total                 cpu_total, in seconds
+//	container_memory_usage_bytes                      memory_usage
+//	container_memory_working_set_bytes                memory_working_set
+//	container_spec_memory_limit_bytes                 memory_limit
+//	container_network_receive_bytes_total             network_rx_bytes
+//	container_network_transmit_bytes_total            network_tx_bytes
+//	container_network_receive_errors_total            network_rx_errors
+//	container_network_transmit_errors_total           network_tx_errors
+//	container_network_receive_packets_dropped_total   network_rx_dropped
+//	container_network_transmit_packets_dropped_total  network_tx_dropped
+//	container_fs_reads_bytes_total                    blkio_read_bytes
+//	container_fs_writes_bytes_total                   blkio_write_bytes
+//
+// Like the container metrics they are only exposed for enabled metric groups.
+// The *_total metrics are counters like in cAdvisor, the others gauges.
+var cadvisorCpuUsageVec *prometheus.CounterVec
+var cadvisorMemUsageVec *prometheus.GaugeVec
+var cadvisorMemWorkingSetVec *prometheus.GaugeVec
+var cadvisorMemLimitVec *prometheus.GaugeVec
+var cadvisorNetRxBytesVec *prometheus.CounterVec
+var cadvisorNetTxBytesVec *prometheus.CounterVec
+var cadvisorNetRxErrorsVec *prometheus.CounterVec
+var cadvisorNetTxErrorsVec *prometheus.CounterVec
+var cadvisorNetRxDroppedVec *prometheus.CounterVec
+var cadvisorNetTxDroppedVec *prometheus.CounterVec
+var cadvisorFsReadsVec *prometheus.CounterVec
+var cadvisorFsWritesVec *prometheus.CounterVec
+
+// registerCompatVector creates and registers a per-container vector named
+// without the exporter namespace
+func registerCompatVector(name string, description string, labels []string) *prometheus.GaugeVec {
+	return addContainerVector(prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: name,
+			Help: description,
+		},
+		labels,
+	))
+}
+
+// registerCompatCounter creates and registers a per-container counter vector
+// named without the exporter namespace
+func registerCompatCounter(name string, description string, labels []string) *prometheus.CounterVec {
+	return addContainerVector(prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: description,
+		},
+		labels,
+	))
+}
+
+// initCompatMetrics creates the vectors of the compatibility mode for the given label set
+func initCompatMetrics(labels []string) {
+	if compatMode != "cadvisor" {
+		return
+	}
+	compatTotals.Clear()
+
+	if metricEnabled("cpu") {
+		cadvisorCpuUsageVec = registerCompatCounter("container_cpu_usage_seconds_total", "Cumulative cpu time consumed in seconds", labels)
+	}
+	if metricEnabled("memory") {
+		cadvisorMemUsageVec = registerCompatVector("container_memory_usage_bytes", "Current memory usage in bytes, including all memory regardless of when it was accessed", labels)
+		cadvisorMemWorkingSetVec = registerCompatVector("container_memory_working_set_bytes", "Current working set in bytes", labels)
+		cadvisorMemLimitVec = registerCompatVector("container_spec_memory_limit_bytes", "Memory limit for the container", labels)
+	}
+	if metricEnabled("network") {
+		cadvisorNetRxBytesVec = registerCompatCounter("container_network_receive_bytes_total", "Cumulative count of bytes received", networkLabelNames(labels))
+		cadvisorNetTxBytesVec = registerCompatCounter("container_network_transmit_bytes_total", "Cumulative count of bytes transmitted", networkLabelNames(labels))
+		cadvisorNetRxErrorsVec = registerCompatCounter("container_network_receive_errors_total", "Cumulative count of errors encountered while receiving", networkLabelNames(labels))
+		cadvisorNetTxErrorsVec = registerCompatCounter("container_network_transmit_errors_total", "Cumulative count of errors encountered while transmitting", networkLabelNames(labels))
+		cadvisorNetRxDroppedVec = registerCompatCounter("container_network_receive_packets_dropped_total", "Cumulative count of packets dropped while receiving", networkLabelNames(labels))
+		cadvisorNetTxDroppedVec = registerCompatCounter("container_network_transmit_packets_dropped_total", "Cumulative count of packets dropped while transmitting", networkLabelNames(labels))
+	}
+	if metricEnabled("blkio") {
+		cadvisorFsReadsVec = registerCompatCounter("container_fs_reads_bytes_total", "Cumulative count of bytes read", labels)
+		cadvisorFsWritesVec = registerCompatCounter("container_fs_writes_bytes_total", "Cumulative count of bytes written", labels)
+	}
+}
+
+// setCompatMetrics publishes the resource usage of a statistic in the compatibility mode.
+// Must be called with metricsLock held.
+func setCompatMetrics(stat *TContainerStatistic, labels prometheus.Labels) {
+	if compatMode != "cadvisor" {
+		return
+	}
+
+	// The counters are increased by the growth of the cumulative docker values
+	if cadvisorCpuUsageVec != nil {
+		cpuSeconds := float64(compatTotals.Delta(labels, "cpu", stat.CPUStats.CPUUsage.TotalUsage)) / 1e9
+		if stat.Platform == "windows" {
+			cpuSeconds *= 100 // usage counted in 100ns intervals
+		}
+		cadvisorCpuUsageVec.With(labels).Add(cpuSeconds)
+	}
+	if cadvisorMemUsageVec != nil {
+		cadvisorMemUsageVec.With(labels).Set(float64(stat.MemoryStats.Usage))
+		cadvisorMemWorkingSetVec.With(labels).Set(float64(memoryWorkingSet(stat)))
+		cadvisorMemLimitVec.With(labels).Set(float64(stat.MemoryStats.Limit))
+	}
+	if cadvisorNetRxBytesVec != nil {
+		for iface, network := range containerNetworks(stat) {
+			ifaceLabels := networkLabels(labels, iface)
+			cadvisorNetRxBytesVec.With(ifaceLabels).Add(float64(compatTotals.Delta(labels, "rx_bytes/"+iface, network.RxBytes)))
+			cadvisorNetTxBytesVec.With(ifaceLabels).Add(float64(compatTotals.Delta(labels, "tx_bytes/"+iface, network.TxBytes)))
+			cadvisorNetRxErrorsVec.With(ifaceLabels).Add(float64(compatTotals.Delta(labels, "rx_errors/"+iface, network.RxErrors)))
+			cadvisorNetTxErrorsVec.With(ifaceLabels).Add(float64(compatTotals.Delta(labels, "tx_errors/"+iface, network.TxErrors)))
+			cadvisorNetRxDroppedVec.With(ifaceLabels).Add(float64(compatTotals.Delta(labels, "rx_dropped/"+iface, network.RxDropped)))
+			cadvisorNetTxDroppedVec.With(ifaceLabels).Add(float64(compatTotals.Delta(labels, "tx_dropped/"+iface, network.TxDropped)))
+		}
+	}
+	if cadvisorFsReadsVec != nil {
+		cadvisorFsReadsVec.With(labels).Add(float64(compatTotals.Delta(labels, "fs_reads", sumBlkioBytes(stat, "read"))))
+		cadvisorFsWritesVec.With(labels).Add(float64(compatTotals.Delta(labels, "fs_writes", sumBlkioBytes(stat, "write"))))
+	}
+}
+
+// deleteCompatMetrics clears the compatibility mode series of a container.
+// Must be called with metricsLock held.
+func deleteCompatMetrics(labels prometheus.Labels) {
+	deleteOptionalMetric(labels,
+		cadvisorMemUsageVec,
+		cadvisorMemWorkingSetVec,
+		cadvisorMemLimitVec,
+	)
+	deleteOptionalCounter(labels,
+		cadvisorCpuUsageVec,
+		cadvisorNetRxBytesVec,
+		cadvisorNetTxBytesVec,
+		cadvisorNetRxErrorsVec,
+		cadvisorNetTxErrorsVec,
+		cadvisorNetRxDroppedVec,
+		cadvisorNetTxDroppedVec,
+		cadvisorFsReadsVec,
+		cadvisorFsWritesVec,
+	)
+	compatTotals.Del(labels)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables which override command line flags not set explicitly
+var flagEnvOverrides = map[string]string{
+	"list-interval":  "DOCKER_STATS_LIST_INTERVAL",
+	"tick-interval":  "DOCKER_STATS_TICK_INTERVAL",
+	"inspect-every":  "DOCKER_STATS_INSPECT_EVERY",
+	"labels-file":    "DOCKER_STATS_LABELS_FILE",
+	"enable-metrics": "DOCKER_STATS_ENABLE_METRICS",
+	"log-level":      "DOCKER_STATS_LOG_LEVEL",
+	"log-format":     "DOCKER_STATS_LOG_FORMAT",
+	"image-labels":   "DOCKER_STATS_IMAGE_LABELS",
+	"compose-labels": "DOCKER_STATS_COMPOSE_LABELS",
+	"node-label":     "DOCKER_STATS_NODE_LABEL",
+	"node-name":      "DOCKER_STATS_NODE_NAME",
+	"all":            "DOCKER_STATS_ALL",
+	"no-id-label":    "DOCKER_STATS_NO_ID",
+	"auth-user":      "DOCKER_STATS_AUTH_USER",
+	"auth-pass":      "DOCKER_STATS_AUTH_PASS",
+}
+
+// applyEnvOverrides sets flags which were not given on the command line from their environment variables
+func applyEnvOverrides() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, env := range flagEnvOverrides {
+		value, found := os.LookupEnv(env)
+		if !found || explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return errors.New(fmt.Sprintf("invalid value %q of %s: %s", value, env, err))
+		}
+	}
+	return nil
+}
+
+// TConfig is the content of the -config JSON file. The file has the lowest
+// precedence: command line flags > environment variables > file > defaults.
+type TConfig struct {
+	Port          int      `json:"port"`
+	ListenAddress string   `json:"listen_address"`
+	ListInterval  string   `json:"list_interval"`
+	TickInterval  string   `json:"tick_interval"`
+	All           *bool    `json:"all"`
+	DockerHost    string   `json:"docker_host"`
+	ScrapeLabels  []string `json:"scrape_labels"`
+	FilterLabels  []string `json:"filter_labels"`
+	FilterName    string   `json:"filter_name"`
+	ExcludeLabels []string `json:"exclude_labels"`
+	EnableMetrics []string `json:"enable_metrics"`
+	TLSCert       string   `json:"tls_cert"`
+	TLSKey        string   `json:"tls_key"`
+	TLSClientCA   string   `json:"tls_client_ca"`
+	LogLevel      string   `json:"log_level"`
+	LogFormat     string   `json:"log_format"`
+}
+
+// loadConfigFile reads the config file, rejecting unknown settings
+func loadConfigFile(path string) (*TConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	config := new(TConfig)
+	if err := decoder.Decode(config); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid config file %s: %s", path, err))
+	}
+	return config, nil
+}
+
+// flagValues returns the flags set in the config file
+func (c *TConfig) flagValues() map[string]string {
+	values := make(map[string]string)
+	if c.Port != 0 {
+		values["port"] = strconv.Itoa(c.Port)
+	}
+	if c.ListenAddress != "" {
+		values["listen-address"] = c.ListenAddress
+	}
+	if c.ListInterval != "" {
+		values["list-interval"] = c.ListInterval
+	}
+	if c.TickInterval != "" {
+		values["tick-interval"] = c.TickInterval
+	}
+	if c.All != nil {
+		values["all"] = strconv.FormatBool(*c.All)
+	}
+	if c.DockerHost != "" {
+		values["docker-host"] = c.DockerHost
+	}
+	if len(c.EnableMetrics) > 0 {
+		values["enable-metrics"] = strings.Join(c.EnableMetrics, ",")
+	}
+	if c.TLSCert != "" {
+		values["tls-cert"] = c.TLSCert
+	}
+	if c.TLSKey != "" {
+		values["tls-key"] = c.TLSKey
+	}
+	if c.TLSClientCA != "" {
+		values["tls-client-ca"] = c.TLSClientCA
+	}
+	if c.LogLevel != "" {
+		values["log-level"] = c.LogLevel
+	}
+	if c.LogFormat != "" {
+		values["log-format"] = c.LogFormat
+	}
+	return values
+}
+
+// envValues returns the settings of the config file which are only read from
+// environment variables
+func (c *TConfig) envValues() map[string]string {
+	values := make(map[string]string)
+	if len(c.ScrapeLabels) > 0 {
+		values["DOCKER_STATS_LABELS_SCRAPE"] = strings.Join(c.ScrapeLabels, ",")
+	}
+	if len(c.FilterLabels) > 0 {
+		values["DOCKER_STATS_FILTER_LABELS"] = strings.Join(c.FilterLabels, " ")
+	}
+	if c.FilterName != "" {
+		values["DOCKER_STATS_FILTER_NAME"] = c.FilterName
+	}
+	if len(c.ExcludeLabels) > 0 {
+		values["DOCKER_STATS_EXCLUDE_LABELS"] = strings.Join(c.ExcludeLabels, " ")
+	}
+	return values
+}
+
+// applyConfigFile fills in the settings given neither on the command line nor in
+// the environment from the config file. Must run after applyEnvOverrides.
+func applyConfigFile(path string) error {
+	config, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, value := range config.flagValues() {
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return errors.New(fmt.Sprintf("invalid value %q of %s in config file: %s", value, name, err))
+		}
+	}
+	for env, value := range config.envValues() {
+		if _, found := os.LookupEnv(env); found {
+			continue
+		}
+		if err := os.Setenv(env, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
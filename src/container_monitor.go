@@ -2,25 +2,77 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
-	"log"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Max number of consecutive malformed frames before the monitor gives up
+const maxDecodeFailures = 5
+
+// Max number of consecutive attempts to re-open a broken stats stream
+const maxStreamReopens = 3
+
+// Default interval between two statistic reads
+const DefaultStatsInterval = 1 * time.Second
+
+// Min default stall timeout: docker streams a frame about every second, with
+// shorter intervals too, so a timeout below a few seconds would restart
+// healthy monitors
+const MinStallTimeout = 3 * time.Second
+
+// Default number of statistic reads between two container inspects
+const DefaultInspectEvery = 5
+
+// Container label overriding the statistic read interval of the container
+const intervalLabel = "docker_stats.interval"
+
 type TContainerMonitor struct {
 	Id     string            // Container ID
-	Name   string            // Container Name
-	Labels map[string]string // Container labels (run-time)
-	cli    *client.Client    // Docker Client
+	Name   string            // Container Name without the leading slash, set on init
+	Labels map[string]string // Container labels (run-time), guarded by optLock once running
+	Cli    TDockerClient     // Docker Client, shared between monitors
+	Host   string            // docker host label, empty when monitoring a single daemon
+
+	Platform      string // OS of the container (linux, windows), detected from the stats stream when empty
+	CgroupVersion string // cgroup version of the container (1, 2), detected from the first statistic when empty
+
+	Interval     time.Duration // statistic read interval, DefaultStatsInterval when not set
+	InspectEvery int           // statistic reads between two container inspects, DefaultInspectEvery when not set
+	StallTimeout time.Duration // max time without a statistic read before the monitor stops, 3 intervals but at least MinStallTimeout when not set
+
+	FsSizeInterval time.Duration // interval of reading the filesystem sizes of the container, 0 to not read them
+
+	optLock sync.RWMutex // guards Name, Labels, the intervals, since, done, cancel and stopped, read by other goroutines
+
+	ctx     context.Context    // monitor context, cancelled on stop
+	cancel  context.CancelFunc // cancels ctx
+	stopped bool               // Stop was called, possibly before Exec
+	done    chan struct{}      // closed once the monitor goroutine returned
+
+	since   time.Time // monitoring start time
+	state   string    // last observed container state
+	running bool      // container was running when the monitor started
+
+	stateSince time.Time    // time the container entered its current state
+	lastRead   atomic.Int64 // unix nano time of the last successful statistic read
 
-	stop bool // thread control flag
+	startupSeconds float64 // time from creation until start, computed once the container runs
+
+	sizeRw     *int64    // last read size of the writable layer
+	sizeRootFs *int64    // last read size of all container files
+	sizedAt    time.Time // time the sizes were last read
 
 	// Callback methods
-	OnStatRead TClbOnStatistic
-	OnRemove   TClbOnRemove
+	OnStatRead    TClbOnStatistic
+	OnRemove      TClbOnRemove
+	OnStateChange TClbOnStateChange
 }
 
 func (m *TContainerMonitor) SetOpt(opt TOpt) error {
@@ -28,6 +80,9 @@ func (m *TContainerMonitor) SetOpt(opt TOpt) error {
 }
 
 func (m *TContainerMonitor) GetOpt(name string) *TOpt {
+	m.optLock.RLock()
+	defer m.optLock.RUnlock()
+
 	switch name {
 	case "name":
 		return &TOpt{
@@ -39,28 +94,91 @@ func (m *TContainerMonitor) GetOpt(name string) *TOpt {
 			Name:  "labels",
 			Value: m.Labels,
 		}
+	case "last_read":
+		return &TOpt{
+			Name:  "last_read",
+			Value: m.lastReadTime(),
+		}
+	case "alive":
+		// Monitor goroutine is still reading the stats stream
+		alive := m.done != nil
+		if alive {
+			select {
+			case <-m.done:
+				alive = false
+			default:
+			}
+		}
+		return &TOpt{
+			Name:  "alive",
+			Value: alive,
+		}
+	case "interval":
+		return &TOpt{
+			Name:  "interval",
+			Value: m.Interval,
+		}
+	case "stall_timeout":
+		return &TOpt{
+			Name:  "stall_timeout",
+			Value: m.StallTimeout,
+		}
 	}
 
 	return nil
 }
 
+// lastReadTime returns the time of the last statistic read, the monitor start
+// time until the first one
+func (m *TContainerMonitor) lastReadTime() time.Time {
+	if nano := m.lastRead.Load(); nano > 0 {
+		return time.Unix(0, nano)
+	}
+	return m.since
+}
+
 func (m *TContainerMonitor) Exec() error {
+	// A monitor stopped while being started (e.g. on shutdown) runs cancelled
+	m.optLock.Lock()
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	if m.stopped {
+		m.cancel()
+	}
+	m.optLock.Unlock()
 	if er := m.init(); er != nil {
+		m.cancel()
 		return er
 	}
 
-	m.stop = false
-	go m.readStream()
+	m.optLock.Lock()
+	m.since = time.Now()
+	m.done = make(chan struct{})
+	m.optLock.Unlock()
+	go func() {
+		defer close(m.done)
+		m.readStream()
+	}()
 
 	return nil
 }
 
+// Done returns a channel closed once the monitor goroutine has returned,
+// including its final OnRemove callback
+func (m *TContainerMonitor) Done() <-chan struct{} {
+	m.optLock.RLock()
+	defer m.optLock.RUnlock()
+	return m.done
+}
+
 func (m *TContainerMonitor) Stop() error {
-	m.stop = true
-	if m.cli == nil {
-		return nil
+	// Aborts in-flight requests and closes the stats stream of the shared client
+	m.optLock.Lock()
+	defer m.optLock.Unlock()
+	m.stopped = true
+	if m.cancel != nil {
+		m.cancel()
 	}
-	return m.cli.Close()
+	return nil
 }
 
 func (m *TContainerMonitor) init() error {
@@ -68,67 +186,319 @@ func (m *TContainerMonitor) init() error {
 		return errors.New("configuration error: container ID must be set")
 	}
 
-	if cli, err := client.NewClientWithOpts(client.FromEnv); err != nil {
-		return err
-	} else {
-		m.cli = cli
+	if m.Cli == nil {
+		return errors.New("configuration error: docker client must be set")
 	}
 
-	if containerInfo, err := m.cli.ContainerInspect(context.Background(), m.Id); err != nil {
+	if containerInfo, err := m.inspect(); err != nil {
 		return err
 	} else {
+		// Known right after Exec, so a monitor stopping early still clears its series
+		m.optLock.Lock()
+		m.Name = normalizeContainerName(containerInfo.Name)
 		m.Labels = containerInfo.Config.Labels
+		m.optLock.Unlock()
+		m.running = containerInfo.State != nil && containerInfo.State.Running
+	}
+
+	// Read by GetOpt from other goroutines while the monitor starts, e.g. on SIGUSR1
+	m.optLock.Lock()
+	defer m.optLock.Unlock()
+	if m.Interval <= 0 {
+		m.Interval = DefaultStatsInterval
+	}
+	if m.InspectEvery <= 0 {
+		m.InspectEvery = DefaultInspectEvery
+	}
+	if value, found := m.Labels[intervalLabel]; found {
+		if interval, err := time.ParseDuration(value); err != nil || interval <= 0 {
+			slog.Warn("Invalid interval label value, using default interval", "container", m.Id[0:12], "label", intervalLabel, "value", value)
+		} else {
+			m.Interval = interval
+		}
+	}
+	if m.StallTimeout <= 0 {
+		m.StallTimeout = max(3*m.Interval, MinStallTimeout)
 	}
 	return nil
 }
 
+// stall stops a monitor whose stats stream delivered nothing within StallTimeout.
+// Cancelling the context closes the stream, so a blocked read returns and the
+// monitor removes itself; the next container list starts a new one.
+func (m *TContainerMonitor) stall() {
+	slog.Warn("No statistic read in time, restarting container monitor", "container", m.Id[0:12], "timeout", m.StallTimeout)
+	if streamStalls != nil {
+		streamStalls.Inc()
+	}
+	m.cancel()
+}
+
 func (m *TContainerMonitor) readStream() {
-	stream, err := m.cli.ContainerStats(context.Background(), m.Id, true)
-	if err != nil {
-		log.Println("Error starting container statistic listening: ", err)
+	if !m.running {
+		m.watchState()
 		return
 	}
-	decoder := json.NewDecoder(stream.Body)
 
+	// Also when the stream can't be opened, e.g. the container exited since the
+	// list, so the monitor doesn't stay in the thread list
 	defer func() {
 		if m.OnRemove != nil {
 			m.OnRemove(m.Id)
 		}
 	}()
 
-	ticker := time.NewTicker(1 * time.Second)
+	stream, err := m.Cli.ContainerStats(m.ctx, m.Id, true)
+	if err != nil {
+		if m.ctx.Err() != nil {
+			return
+		}
+		if client.IsErrNotFound(err) {
+			slog.Debug("Container removed before its statistic stream was opened", "container", m.Id[0:12])
+			return
+		}
+		countApiError("stats", err)
+		slog.Error("Error starting container statistic listening", "container", m.Id[0:12], "err", err)
+		return
+	}
+	// Closed on every return, a stream left open keeps its connection to the daemon.
+	// The stream is replaced on re-open, so the current one is closed.
+	defer func() {
+		if stream.Body != nil {
+			_ = stream.Body.Close()
+		}
+	}()
+	if m.Platform == "" {
+		m.Platform = stream.OSType
+	}
+	reader := newStatsReader(stream.Body)
+	reopens := 0
+
+	ticker := time.NewTicker(m.Interval)
 	defer ticker.Stop()
 
+	watchdog := time.AfterFunc(m.StallTimeout, m.stall)
+	defer watchdog.Stop()
+
+	decodeFailures := 0
+
+	// The stats stream only proves the container is alive, its state and details
+	// are refreshed from an inspect every InspectEvery reads
+	var containerInspect types.ContainerJSON
+	inspectDue := true
+	reads := 0
+
 	for {
 		select {
+		case <-m.ctx.Done():
+			return
 		case <-ticker.C:
-			if m.stop {
+			// Waits for a slot with -max-parallel-reads, the most stale monitor first
+			if er := readScheduler.Acquire(m.ctx, m.lastReadTime()); er != nil {
 				return
 			}
+			statistic, er := reader.Latest()
+			readScheduler.Release()
+			if er != nil {
+				if m.ctx.Err() != nil {
+					return // stopped while reading
+				}
+				if errors.Is(er, io.EOF) {
+					slog.Info("Statistic stream closed, container is gone", "container", m.Id[0:12])
+					return
+				}
+				if !IsMalformedFrame(er) {
+					// Transient read error, the container may still be running
+					if reopens >= maxStreamReopens {
+						slog.Error("Error reading from input, giving up", "container", m.Id[0:12], "reopens", reopens, "err", er)
+						return
+					}
+					reopens++
+					slog.Warn("Error reading from input, re-opening statistic stream", "container", m.Id[0:12], "err", er)
 
-			statistic := new(TContainerStatistic)
-			if er := decoder.Decode(statistic); er != nil {
-				log.Println("Error reading from input:", er)
-				return
-			}
+					_ = stream.Body.Close()
+					if stream, err = m.Cli.ContainerStats(m.ctx, m.Id, true); err != nil {
+						if m.ctx.Err() == nil {
+							countApiError("stats", err)
+						}
+						slog.Error("Error re-opening container statistic stream", "container", m.Id[0:12], "err", err)
+						return
+					}
+					reader = newStatsReader(stream.Body)
+					inspectDue = true
+					continue
+				}
 
-			containerInspect, err := m.cli.ContainerInspect(context.Background(), m.Id)
-			if err != nil {
-				log.Println("Error inspecting container:", err)
-				return
+				if decodeErrors != nil {
+					decodeErrors.Inc()
+				}
+				decodeFailures++
+				if decodeFailures >= maxDecodeFailures {
+					slog.Error("Too many malformed statistic frames, stop monitoring", "container", m.Id[0:12], "err", er)
+					return
+				}
+
+				// The frame was read whole, the next one is decoded on the next tick
+				slog.Warn("Skipping malformed statistic frame", "container", m.Id[0:12], "err", er)
+				continue
+			}
+			decodeFailures = 0
+			reopens = 0
+			m.lastRead.Store(time.Now().UnixNano())
+			watchdog.Reset(m.StallTimeout)
+			if m.CgroupVersion == "" && m.Platform != "windows" {
+				m.CgroupVersion = detectCgroupVersion(statistic)
 			}
-			containerState := containerInspect.State.Status // 获取容器的运行状态
-			statistic.RunningState = containerState
+			slog.Debug("Statistic read", "container", m.Id[0:12], "read", statistic.Read)
 
-			if m.Name == "" {
-				m.Name = statistic.Name
+			// A frame without processes means the container is stopping
+			reads++
+			if inspectDue || reads >= m.InspectEvery || statistic.PidsStats.Current == 0 {
+				containerInspect, err = m.inspect()
+				if err != nil {
+					if m.ctx.Err() != nil {
+						return
+					}
+					if client.IsErrNotFound(err) {
+						slog.Debug("Container removed while inspecting", "container", m.Id[0:12])
+						return
+					}
+					slog.Error("Error inspecting container", "container", m.Id[0:12], "err", err)
+					return
+				}
+				inspectDue = false
+				reads = 0
+			}
+			if m.FsSizeInterval > 0 && time.Since(m.sizedAt) >= m.FsSizeInterval {
+				// Computing sizes may take longer than the stall timeout, it's no stalled stream
+				watchdog.Stop()
+				m.readSizes()
+				watchdog.Reset(m.StallTimeout)
 			}
+			m.emit(statistic, containerInspect)
+		}
+	}
+}
+
+// watchState emits state-only statistics of a container which is not running,
+// since docker doesn't stream resource usage for it. Returns once the container
+// is running again, so the monitor gets re-created with a stats stream. Like the
+// stream the container is inspected every InspectEvery ticks only.
+func (m *TContainerMonitor) watchState() {
+	defer func() {
+		if m.OnRemove != nil {
+			m.OnRemove(m.Id)
+		}
+	}()
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	var containerInspect types.ContainerJSON
+	inspectDue := true
+	reads := 0
 
-			statistic.Labels = m.Labels
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			reads++
+			if inspectDue || reads >= m.InspectEvery {
+				var err error
+				containerInspect, err = m.inspect()
+				if err != nil {
+					if m.ctx.Err() != nil {
+						return
+					}
+					if client.IsErrNotFound(err) {
+						slog.Debug("Container removed while inspecting", "container", m.Id[0:12])
+						return
+					}
+					slog.Error("Error inspecting container", "container", m.Id[0:12], "err", err)
+					return
+				}
+				if containerInspect.State.Running {
+					return
+				}
+				inspectDue = false
+				reads = 0
+			}
 
-			if m.OnStatRead != nil {
-				m.OnStatRead(statistic)
+			statistic := &TContainerStatistic{
+				Id:        m.Id,
+				Name:      containerInspect.Name,
+				StateOnly: true,
 			}
+			m.emit(statistic, containerInspect)
 		}
 	}
 }
+
+// inspect fetches the container details, counting the Docker API calls
+func (m *TContainerMonitor) inspect() (types.ContainerJSON, error) {
+	if inspectCalls != nil {
+		inspectCalls.Inc()
+	}
+	containerInspect, err := m.Cli.ContainerInspect(m.ctx, m.Id)
+	if err != nil && m.ctx.Err() == nil && !client.IsErrNotFound(err) {
+		countApiError("inspect", err)
+	}
+	return containerInspect, err
+}
+
+// readSizes reads the filesystem sizes of the container. Computing them walks
+// the container files, so errors are only logged and retried on the next interval.
+func (m *TContainerMonitor) readSizes() {
+	m.sizedAt = time.Now()
+	if inspectCalls != nil {
+		inspectCalls.Inc()
+	}
+	containerInspect, _, err := m.Cli.ContainerInspectWithRaw(m.ctx, m.Id, true)
+	if err != nil {
+		if m.ctx.Err() == nil && !client.IsErrNotFound(err) {
+			countApiError("inspect", err)
+			slog.Warn("Error reading container filesystem sizes", "container", m.Id[0:12], "err", err)
+		}
+		return
+	}
+	m.sizeRw = containerInspect.SizeRw
+	m.sizeRootFs = containerInspect.SizeRootFs
+}
+
+// emit completes the statistic with container details and passes it to the callbacks
+func (m *TContainerMonitor) emit(statistic *TContainerStatistic, containerInspect types.ContainerJSON) {
+	containerState := containerInspect.State.Status // 获取容器的运行状态
+	statistic.RunningState = containerState
+
+	statistic.Labels = m.Labels
+	statistic.Host = m.Host
+	statistic.Platform = m.Platform
+	statistic.CgroupVersion = m.CgroupVersion
+	statistic.Inspect = containerInspect
+	statistic.MonitoredSince = m.since
+	if m.startupSeconds == 0 {
+		m.startupSeconds = containerStartupSeconds(containerInspect)
+	}
+	statistic.StartupSeconds = m.startupSeconds
+	statistic.SizeRw = m.sizeRw
+	statistic.SizeRootFs = m.sizeRootFs
+
+	if m.state != containerState {
+		// The state duration survives exporter restarts like in pull mode, the
+		// daemon knows since when the container runs or stopped
+		m.stateSince = time.Now()
+		if since := containerStateSince(containerInspect); m.state == "" && !since.IsZero() {
+			m.stateSince = since
+		}
+		if m.state != "" && m.OnStateChange != nil {
+			m.OnStateChange(statistic, m.state)
+		}
+	}
+	m.state = containerState
+	statistic.StateSince = m.stateSince
+
+	if m.OnStatRead != nil {
+		m.OnStatRead(statistic)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testContainerId = "c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00"
+
+// A stats frame of a running container as the daemon streams it
+const testStatsFrame = `{"id":"` + testContainerId + `","name":"/test","read":"2024-01-01T00:00:01Z","pids_stats":{"current":1},"cpu_stats":{"cpu_usage":{"total_usage":1000000000},"system_cpu_usage":10000000000,"online_cpus":1}}` + "\n"
+
+// newFakeClient returns a fake client serving a running container with the stats frames
+func newFakeClient(stats string) *TFakeDockerClient {
+	return &TFakeDockerClient{
+		Container: types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:         testContainerId,
+				Name:       "/test",
+				State:      &types.ContainerState{Status: "running", Running: true},
+				HostConfig: &container.HostConfig{},
+			},
+			Config: &container.Config{Labels: map[string]string{}},
+		},
+		Stats: stats,
+	}
+}
+
+// TFailingStatsClient can't open the stats stream of its container
+type TFailingStatsClient struct {
+	*TFakeDockerClient
+}
+
+func (c *TFailingStatsClient) ContainerStats(ctx context.Context, containerID string, stream bool) (types.ContainerStats, error) {
+	return types.ContainerStats{}, errors.New("stats stream unavailable")
+}
+
+// TFakeStream is a stats stream serving Frames, then ending with End. A stream
+// without End stays open until its request is cancelled or its body closed,
+// serving Frames again every Repeat when set.
+type TFakeStream struct {
+	Frames string
+	End    error
+	Repeat time.Duration
+}
+
+// TFakeStatsBody records whether the stats stream body was closed
+type TFakeStatsBody struct {
+	*io.PipeReader
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (b *TFakeStatsBody) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return b.PipeReader.Close()
+}
+
+func (b *TFakeStatsBody) Closed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// TStreamsClient serves its streams in order, one per ContainerStats call, and
+// fails once they are used up. Like the body of the docker client a stream is
+// closed when its request is cancelled.
+type TStreamsClient struct {
+	*TFakeDockerClient
+	Streams []TFakeStream
+
+	lock   sync.Mutex
+	bodies []*TFakeStatsBody
+}
+
+func (c *TStreamsClient) ContainerStats(ctx context.Context, containerID string, stream bool) (types.ContainerStats, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.bodies) >= len(c.Streams) {
+		return types.ContainerStats{}, errors.New("stats stream unavailable")
+	}
+	fake := c.Streams[len(c.bodies)]
+
+	reader, writer := io.Pipe()
+	body := &TFakeStatsBody{PipeReader: reader, closed: make(chan struct{})}
+	c.bodies = append(c.bodies, body)
+	go func() {
+		if fake.Frames != "" {
+			if _, er := writer.Write([]byte(fake.Frames)); er != nil {
+				return
+			}
+		}
+		if fake.End != nil {
+			_ = writer.CloseWithError(fake.End)
+			return
+		}
+		for {
+			var repeat <-chan time.Time
+			if fake.Repeat > 0 {
+				repeat = time.After(fake.Repeat)
+			}
+			select {
+			case <-ctx.Done():
+				_ = writer.CloseWithError(ctx.Err())
+				return
+			case <-body.closed:
+				return
+			case <-repeat:
+				if _, er := writer.Write([]byte(fake.Frames)); er != nil {
+					return
+				}
+			}
+		}
+	}()
+	return types.ContainerStats{Body: body, OSType: "linux"}, nil
+}
+
+// Bodies returns the bodies of the opened streams
+func (c *TStreamsClient) Bodies() []*TFakeStatsBody {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*TFakeStatsBody(nil), c.bodies...)
+}
+
+// newStreamsMonitor returns a listed monitor reading the streams every millisecond
+func newStreamsMonitor(t *testing.T, streams ...TFakeStream) (*TContainerMonitor, *TStreamsClient) {
+	t.Helper()
+	setGlobal(t, &statsThreads, new(ThreadList))
+
+	cli := &TStreamsClient{TFakeDockerClient: newFakeClient(""), Streams: streams}
+	mon := new(TContainerMonitor)
+	mon.Id = testContainerId
+	mon.Cli = cli
+	mon.Interval = time.Millisecond
+	mon.StallTimeout = time.Minute
+	mon.OnRemove = new(TDockerEndpoint).containerStopped
+	if err := statsThreads.Put(mon.Id, mon); err != nil {
+		t.Fatal(err)
+	}
+	return mon, cli
+}
+
+// waitDone waits for a monitor goroutine to return
+func waitDone(t *testing.T, mon *TContainerMonitor) {
+	t.Helper()
+	select {
+	case <-mon.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("container monitor did not finish")
+	}
+}
+
+func TestMonitorRemovedWhenStatsFail(t *testing.T) {
+	setGlobal(t, &statsThreads, new(ThreadList))
+
+	mon := new(TContainerMonitor)
+	mon.Id = testContainerId
+	mon.Cli = &TFailingStatsClient{newFakeClient("")}
+	mon.OnRemove = new(TDockerEndpoint).containerStopped
+
+	// Listed before it runs, like startMonitor does
+	if err := statsThreads.Put(mon.Id, mon); err != nil {
+		t.Fatal(err)
+	}
+	if err := mon.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, mon)
+
+	if _, found := statsThreads.Get(mon.Id); found {
+		t.Error("monitor with a failed stats stream is still listed")
+	}
+}
+
+func TestStateSinceFromDaemon(t *testing.T) {
+	startedAt := time.Now().Add(-5 * time.Minute).UTC().Truncate(time.Second)
+	inspect := newFakeClient("").Container
+	inspect.State.StartedAt = startedAt.Format(time.RFC3339Nano)
+
+	var emitted *TContainerStatistic
+	mon := new(TContainerMonitor)
+	mon.Id = testContainerId
+	mon.OnStatRead = func(statistic *TContainerStatistic) { emitted = statistic }
+
+	// First observed by a just started monitor, the state began with the container
+	mon.emit(new(TContainerStatistic), inspect)
+	if !emitted.StateSince.Equal(startedAt) {
+		t.Errorf("state since = %v, expected the start time %v", emitted.StateSince, startedAt)
+	}
+
+	// A state change seen by the monitor begins now
+	inspect.State = &types.ContainerState{Status: "paused", Running: true, Paused: true, StartedAt: inspect.State.StartedAt}
+	before := time.Now()
+	mon.emit(new(TContainerStatistic), inspect)
+	if emitted.StateSince.Before(before) {
+		t.Errorf("state since of an observed change = %v, expected now", emitted.StateSince)
+	}
+}
+
+func TestMonitorStopsOnStalledStream(t *testing.T) {
+	initTestMetrics(t)
+
+	// The stream is open but delivers no frame
+	mon, cli := newStreamsMonitor(t, TFakeStream{})
+	mon.StallTimeout = 50 * time.Millisecond
+	if err := mon.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, mon)
+
+	if _, found := statsThreads.Get(mon.Id); found {
+		t.Error("monitor with a stalled stream is still listed")
+	}
+	if stalls := gatherFamilies(t)["docker_stats_stream_stalls_total"]; stalls == nil || stalls.GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Errorf("stream stalls = %v, expected 1", stalls.GetMetric())
+	}
+	for _, body := range cli.Bodies() {
+		if !body.Closed() {
+			t.Error("stalled stream body was not closed")
+		}
+	}
+}
+
+func TestDefaultStallTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		expected time.Duration
+	}{
+		// Docker streams a frame about every second also with shorter intervals
+		{name: "sub-second interval", interval: 100 * time.Millisecond, expected: MinStallTimeout},
+		{name: "default interval", interval: DefaultStatsInterval, expected: 3 * time.Second},
+		{name: "long interval", interval: 10 * time.Second, expected: 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mon := new(TContainerMonitor)
+			mon.Id = testContainerId
+			mon.Cli = newFakeClient("")
+			mon.Interval = test.interval
+			if err := mon.init(); err != nil {
+				t.Fatal(err)
+			}
+			if mon.StallTimeout != test.expected {
+				t.Errorf("stall timeout = %v, expected %v", mon.StallTimeout, test.expected)
+			}
+		})
+	}
+}
+
+func TestStopWhileReading(t *testing.T) {
+	initTestMetrics(t)
+
+	// The daemon keeps sending frames while the monitor reads them
+	mon, _ := newStreamsMonitor(t, TFakeStream{Frames: testStatsFrame, Repeat: time.Millisecond})
+	var reads atomic.Int32
+	reading := make(chan struct{})
+	mon.OnStatRead = func(statistic *TContainerStatistic) {
+		if reads.Add(1) == 3 {
+			close(reading)
+		}
+	}
+	if err := mon.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor did not read statistics")
+	}
+
+	// The main loop reads the options while the monitor reads and gets stopped
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if name := mon.GetOpt("name").Value.(string); name != "test" {
+					t.Errorf("name = %q, expected %q", name, "test")
+					return
+				}
+				_ = mon.GetOpt("labels")
+				_ = mon.GetOpt("last_read")
+				_ = mon.GetOpt("alive")
+			}
+		}()
+	}
+	if err := mon.Stop(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+	waitDone(t, mon)
+
+	if _, found := statsThreads.Get(mon.Id); found {
+		t.Error("stopped monitor is still listed")
+	}
+	if alive := mon.GetOpt("alive").Value.(bool); alive {
+		t.Error("stopped monitor is alive")
+	}
+}
+
+func TestStreamBodyClosed(t *testing.T) {
+	reset := errors.New("connection reset by peer")
+
+	tests := []struct {
+		name    string
+		streams []TFakeStream
+		stop    bool
+		opened  int
+	}{
+		{name: "end of stream", streams: []TFakeStream{{Frames: testStatsFrame, End: io.EOF}}, opened: 1},
+		{name: "stopped", streams: []TFakeStream{{Frames: testStatsFrame}}, stop: true, opened: 1},
+		{name: "re-opened", streams: []TFakeStream{{Frames: testStatsFrame, End: reset}, {Frames: testStatsFrame, End: io.EOF}}, opened: 2},
+		{name: "re-open failed", streams: []TFakeStream{{Frames: testStatsFrame, End: reset}}, opened: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initTestMetrics(t)
+
+			mon, cli := newStreamsMonitor(t, test.streams...)
+			if err := mon.Exec(); err != nil {
+				t.Fatal(err)
+			}
+			if test.stop {
+				deadline := time.Now().Add(5 * time.Second)
+				for mon.lastRead.Load() == 0 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				_ = mon.Stop()
+			}
+			waitDone(t, mon)
+
+			bodies := cli.Bodies()
+			if len(bodies) != test.opened {
+				t.Errorf("%d streams opened, expected %d", len(bodies), test.opened)
+			}
+			for i, body := range bodies {
+				if !body.Closed() {
+					t.Errorf("body of stream %d was not closed", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestOptionsWhileStarting(t *testing.T) {
+	initTestMetrics(t)
+
+	// Listed before Exec, a monitor dump may read its options while it starts
+	mon, _ := newStreamsMonitor(t, TFakeStream{Frames: testStatsFrame})
+	mon.Interval = 0
+	mon.StallTimeout = 0
+	started := make(chan error)
+	go func() { started <- mon.Exec() }()
+	for running := true; running; {
+		select {
+		case err := <-started:
+			if err != nil {
+				t.Fatal(err)
+			}
+			running = false
+		default:
+			_ = mon.GetOpt("interval")
+			_ = mon.GetOpt("stall_timeout")
+		}
+	}
+
+	if interval := mon.GetOpt("interval").Value.(time.Duration); interval != DefaultStatsInterval {
+		t.Errorf("interval = %v, expected %v", interval, DefaultStatsInterval)
+	}
+	if stallTimeout := mon.GetOpt("stall_timeout").Value.(time.Duration); stallTimeout != MinStallTimeout {
+		t.Errorf("stall timeout = %v, expected %v", stallTimeout, MinStallTimeout)
+	}
+	_ = mon.Stop()
+	waitDone(t, mon)
+}
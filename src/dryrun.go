@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runDryRun lists the containers every endpoint would monitor with the labels
+// of their series, without starting any monitor. Returns the process exit code.
+func runDryRun(endpoints []*TDockerEndpoint) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	failed := false
+	for _, ep := range endpoints {
+		containerList, err := ep.listContainers(ctx)
+		if err != nil {
+			fmt.Println("FAIL: can not list containers of", ep.Cli.DaemonHost()+":", err)
+			failed = true
+			continue
+		}
+		fmt.Println("Containers to monitor on", ep.Cli.DaemonHost()+":", len(containerList))
+
+		for _, cont := range containerList {
+			stat := new(TContainerStatistic)
+			stat.Id = cont.ID
+			stat.Host = ep.Label
+			stat.Labels = cont.Labels
+			if len(cont.Names) > 0 {
+				stat.Name = cont.Names[0]
+			}
+			if imageLabels {
+				// Image labels are read from the inspect result, like the monitors do
+				if containerInspect, er := ep.Cli.ContainerInspect(ctx, cont.ID); er == nil {
+					stat.Inspect = containerInspect
+				}
+			}
+			fmt.Println(" ", normalizeContainerName(stat.Name), formatLabels(statisticLabels(stat)))
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// formatLabels formats labels in the Prometheus exposition style, ordered by name
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
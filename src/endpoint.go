@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TDockerEndpoint polls the container list of a single Docker daemon and runs
+// the monitors of its containers. Endpoints are independent of each other, an
+// unreachable daemon only delays its own poll loop.
+type TDockerEndpoint struct {
+	Host  string         // daemon address, empty for the DOCKER_HOST environment default
+	Label string         // value of the host label, empty when monitoring a single daemon
+	Cli   *client.Client // Docker API client of the daemon
+
+	Platform      string // OS of the daemon containers (linux, windows), detected on connect when empty
+	CgroupVersion string // cgroup version of the daemon (1, 2), detected on connect
+
+	ListInterval       time.Duration
+	TickInterval       time.Duration
+	InspectEvery       int
+	StallTimeout       time.Duration
+	FsSizeInterval     time.Duration
+	ListAll            bool
+	Filters            filters.Args
+	NameFilter         *regexp.Regexp
+	ExcludeLabels      []string // label specs of containers not to monitor, see excludeContainersByLabel
+	StartupConcurrency int      // max number of monitors started in parallel on the first list
+
+	OnFirstCycle func() // called once after the first refresh, successful or not
+
+	started bool // monitors of the first container list have been started
+}
+
+// Max number of monitored containers across all endpoints, 0 for no limit
+var maxMonitored int
+
+// monitorLimitLock serializes monitor starts of the endpoints while the limit applies
+var monitorLimitLock sync.Mutex
+var monitorLimitLogged bool
+
+// connect creates the API client of the endpoint and logs the daemon version.
+// A daemon which is not reachable yet is only logged, the poll loop keeps retrying.
+func (ep *TDockerEndpoint) connect() error {
+	c, err := newDockerClient(ep.Host)
+	if err != nil {
+		return err
+	}
+	ep.Cli = c
+	slog.Info("Docker client created", "host", ep.Cli.DaemonHost(), "version", ep.Cli.ClientVersion())
+
+	version, er := ep.Cli.ServerVersion(context.Background())
+	daemonHealth.Set(ep.Label, er)
+	// Published once the daemon name is known, it's part of the node label
+	defer setDaemonUp(ep.Label, er)
+	countApiError("version", er)
+	if er != nil {
+		slog.Error("Can not connect to Docker daemon", "host", ep.Cli.DaemonHost(), "err", er)
+	} else {
+		slog.Info("Docker server version", "host", ep.Cli.DaemonHost(), "version", version.Version, "api_version", version.APIVersion, "client_api_version", ep.Cli.ClientVersion(), "os", version.Os)
+		if ep.Platform == "" {
+			ep.Platform = version.Os
+		}
+	}
+
+	if info, er := ep.Cli.Info(context.Background()); er != nil {
+		countApiError("info", er)
+		slog.Error("Error getting server info", "host", ep.Cli.DaemonHost(), "err", er)
+	} else {
+		if info.MemTotal > 0 {
+			hostMemTotal[ep.Label] = uint64(info.MemTotal)
+		}
+		ep.CgroupVersion = info.CgroupVersion
+		hostNodeNames[ep.Label] = info.Name
+	}
+	return nil
+}
+
+// poll refreshes the container monitors of the endpoint every ListInterval until
+// ctx is cancelled, backing off exponentially while the daemon is unreachable
+func (ep *TDockerEndpoint) poll(ctx context.Context) {
+	var listBackoff time.Duration
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		delay := ep.ListInterval
+		err := ep.refresh(ctx)
+		if ctx.Err() == nil {
+			setDaemonUp(ep.Label, err)
+		}
+		if ep.OnFirstCycle != nil {
+			ep.OnFirstCycle()
+			ep.OnFirstCycle = nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Keep the last known metrics and retry with exponential backoff
+			if listBackoff == 0 {
+				listBackoff = ep.ListInterval
+			} else {
+				listBackoff = min(listBackoff*2, MaxContainersListBackoff)
+			}
+			delay = listBackoff
+			slog.Error("Error getting container list", "host", ep.Cli.DaemonHost(), "retry_in", listBackoff, "err", err)
+		} else {
+			listBackoff = 0
+		}
+		timer.Reset(delay)
+	}
+}
+
+// listContainers returns the containers of the daemon to monitor and updates the container count
+func (ep *TDockerEndpoint) listContainers(ctx context.Context) ([]types.Container, error) {
+	containerList, err := ep.Cli.ContainerList(ctx, container.ListOptions{
+		All:     ep.ListAll,
+		Filters: ep.Filters,
+	})
+	daemonHealth.Set(ep.Label, err)
+	if err != nil {
+		if ctx.Err() == nil {
+			countApiError("list", err)
+		}
+		return nil, err
+	}
+
+	if ep.NameFilter != nil {
+		containerList = filterContainersByName(containerList, ep.NameFilter)
+	}
+	if len(ep.ExcludeLabels) > 0 {
+		containerList = excludeContainersByLabel(containerList, ep.ExcludeLabels)
+	}
+	containerList = excludeSelf(containerList)
+
+	containersCount.With(hostLabels(ep.Label)).Set(float64(len(containerList)))
+	return containerList, nil
+}
+
+// refresh starts monitors for new containers and stops those of removed ones
+func (ep *TDockerEndpoint) refresh(ctx context.Context) error {
+	started := time.Now()
+	defer func() {
+		scrapeDurationVec.With(hostLabels(ep.Label)).Set(time.Since(started).Seconds())
+	}()
+
+	containerList, err := ep.listContainers(ctx)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool, len(containerList))
+	names := make(map[string]bool, len(containerList))
+	for _, cont := range containerList {
+		listed[ep.key(cont.ID)] = true
+		for _, name := range cont.Names {
+			names[normalizeContainerName(name)] = true
+		}
+	}
+
+	// A container recreated with the same name gets a new ID. Without the ID label
+	// the series of both collide, so the old monitor is stopped and its metrics are
+	// cleared before the new container is monitored.
+	var removed, recreated []string
+	prefix := ep.key("")
+	for _, key := range statsThreads.GetKeys() {
+		if !strings.HasPrefix(key, prefix) || listed[key] {
+			continue
+		}
+		th, found := statsThreads.Get(key)
+		if !found {
+			continue
+		}
+		if opt := th.GetOpt("name"); opt != nil && names[normalizeContainerName(opt.Value.(string))] {
+			recreated = append(recreated, key)
+		} else {
+			removed = append(removed, key)
+		}
+	}
+	if len(recreated) > 0 {
+		ep.stopRecreated(ctx, recreated)
+	}
+
+	var added []string
+	for _, cont := range containerList {
+		if !statsThreads.Exists(ep.key(cont.ID)) {
+			added = append(added, cont.ID)
+		}
+	}
+
+	// Many containers exist on the first list, start their monitors in parallel
+	concurrency := 1
+	if !ep.started {
+		concurrency = ep.StartupConcurrency
+		ep.started = true
+	}
+	if maxMonitored > 0 {
+		monitorLimitLock.Lock()
+		ep.startMonitors(limitMonitors(added), concurrency)
+		monitorLimitLock.Unlock()
+	} else {
+		ep.startMonitors(added, concurrency)
+	}
+
+	// Stop monitoring removed containers, waiting at most one list interval
+	// until they have cleared their metrics
+	stopCtx, cancel := context.WithTimeout(ctx, ep.ListInterval)
+	defer cancel()
+	if er := statsThreads.StopKeys(stopCtx, removed); er != nil && ctx.Err() == nil {
+		slog.Warn("Monitors of removed containers did not finish in time")
+	}
+	return nil
+}
+
+// limitMonitors returns the containers which fit below -max-monitored and counts
+// the others as skipped. The limit is logged once each time it is reached.
+// Must be called with monitorLimitLock held.
+func limitMonitors(containerIds []string) []string {
+	free := max(maxMonitored-statsThreads.Len(), 0)
+	if len(containerIds) <= free {
+		monitorLimitLogged = false
+		return containerIds
+	}
+
+	skipped := len(containerIds) - free
+	monitorsSkipped.Add(float64(skipped))
+	if !monitorLimitLogged {
+		slog.Warn("Max number of monitored containers reached, not monitoring new containers", "max_monitored", maxMonitored, "skipped", skipped)
+		monitorLimitLogged = true
+	}
+	return containerIds[:free]
+}
+
+// startMonitors starts monitors of the given containers, running at most concurrency starts in parallel
+func (ep *TDockerEndpoint) startMonitors(containerIds []string, concurrency int) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(concurrency, 1))
+
+	for _, containerId := range containerIds {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(containerId string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			ep.startMonitor(containerId)
+		}(containerId)
+	}
+	wg.Wait()
+}
+
+func (ep *TDockerEndpoint) startMonitor(containerId string) {
+	mon := new(TContainerMonitor)
+	mon.Id = containerId
+	mon.Host = ep.Label
+	mon.Cli = ep.Cli
+	mon.Platform = ep.Platform
+	mon.CgroupVersion = ep.CgroupVersion
+	mon.Interval = ep.TickInterval
+	mon.InspectEvery = ep.InspectEvery
+	mon.StallTimeout = ep.StallTimeout
+	mon.FsSizeInterval = ep.FsSizeInterval
+	mon.OnStatRead = containerStatisticRead
+	mon.OnRemove = ep.containerStopped
+	mon.OnStateChange = containerStateChanged
+
+	// Listed before it runs, a monitor failing right away removes itself again
+	key := ep.key(containerId)
+	if e := statsThreads.Put(key, mon); e != nil {
+		slog.Error("Error adding thread to list", "container", containerId[0:12], "err", e)
+		return
+	}
+	if e := mon.Exec(); e != nil {
+		statsThreads.Del(key)
+		slog.Error("Error executing container monitor", "container", containerId[0:12], "err", e)
+		return
+	}
+	countMonitorRestart(ep.Label, mon.GetOpt("name").Value.(string), mon.GetOpt("labels").Value.(map[string]string))
+	slog.Info("Start monitoring for container", "container", containerId[0:12])
+}
+
+// monitorSingle monitors a single container given by ID or name, see -container.
+// The monitor is restarted whenever it ends while the container still exists,
+// e.g. after a stalled stream or once a stopped container runs again. Returns a
+// channel closed once an inspect finds the container gone.
+func (ep *TDockerEndpoint) monitorSingle(ctx context.Context, ref string) (<-chan struct{}, error) {
+	containerInspect, err := ep.Cli.ContainerInspect(ctx, ref)
+	if err != nil {
+		countApiError("inspect", err)
+		return nil, err
+	}
+	containerId := containerInspect.ID
+	key := ep.key(containerId)
+
+	ep.startMonitor(containerId)
+	th, found := statsThreads.Get(key)
+	if !found {
+		return nil, errors.New(fmt.Sprintf("monitor of container %s did not start", ref))
+	}
+	containersCount.With(hostLabels(ep.Label)).Set(1)
+
+	gone := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-th.Done():
+			case <-ctx.Done():
+				return
+			}
+
+			// Retried every list interval while the daemon can't tell
+			for {
+				_, err := ep.Cli.ContainerInspect(ctx, containerId)
+				if ctx.Err() != nil {
+					return
+				}
+				if client.IsErrNotFound(err) {
+					close(gone)
+					return
+				}
+				if err != nil {
+					countApiError("inspect", err)
+					slog.Error("Error inspecting the monitored container", "container", containerId[0:12], "err", err)
+				} else {
+					slog.Info("Monitor of the container ended, restarting it", "container", containerId[0:12])
+					ep.startMonitor(containerId)
+					if th, found = statsThreads.Get(key); found {
+						break
+					}
+				}
+
+				select {
+				case <-time.After(ep.ListInterval):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return gone, nil
+}
+
+// stopRecreated stops the monitors of recreated containers and waits, at most
+// one list interval, until they have cleared their metrics
+func (ep *TDockerEndpoint) stopRecreated(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		slog.Info("Container was recreated, clearing its old metrics", "key", key)
+	}
+
+	stopCtx, cancel := context.WithTimeout(ctx, ep.ListInterval)
+	defer cancel()
+	if er := statsThreads.StopKeys(stopCtx, keys); er != nil && ctx.Err() == nil {
+		slog.Warn("Monitors of recreated containers did not finish in time")
+	}
+}
+
+// key returns the thread list key of a container of the endpoint
+func (ep *TDockerEndpoint) key(containerId string) string {
+	if ep.Label == "" {
+		return containerId
+	}
+	return ep.Label + "#" + containerId
+}
+
+func (ep *TDockerEndpoint) containerStopped(containerId string) {
+	slog.Info("Stop container monitoring", "container", containerId[0:12])
+
+	key := ep.key(containerId)
+	thread, found := statsThreads.Get(key)
+	if !found {
+		slog.Warn("Container is not monitored", "container", containerId)
+		return
+	}
+	// Stop and remove container monitor
+	if er := thread.Stop(); er != nil {
+		slog.Error("Error stopping container monitor", "container", containerId[0:12], "err", er)
+	}
+	statsThreads.Del(key)
+
+	// Clear container metrics
+	name := thread.GetOpt("name")
+	labels := thread.GetOpt("labels")
+	deleteContainerMetrics(containerLabels(ep.Label, containerId, name.Value.(string), labels.Value.(map[string]string)))
+	recentStops.Stopped(ep.Label, name.Value.(string))
+	statsCache.Del(ep.Label, containerId)
+	labelGuard.Forget(containerId)
+}
+
+// splitHosts returns the non-empty addresses of a comma separated host list
+func splitHosts(list string) []string {
+	var res []string
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			res = append(res, host)
+		}
+	}
+	return res
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var labelNameRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// metricsHandler serves metrics from the gatherer. When one or more
+// ?label=key=value query parameters are given, only series matching all of
+// them are returned.
+func metricsHandler(gatherer prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	unfiltered := promhttp.HandlerFor(gatherer, opts)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params, ok := r.URL.Query()["label"]
+		if !ok {
+			unfiltered.ServeHTTP(w, r)
+			return
+		}
+
+		matchers, err := parseLabelMatchers(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		promhttp.HandlerFor(filterGatherer(gatherer, matchers), opts).ServeHTTP(w, r)
+	})
+}
+
+// Set once the first list-and-monitor pass of all endpoints completed
+var metricsReady atomic.Bool
+
+// requireReady answers 503 until the first monitoring pass completed, so a
+// scrape during startup doesn't record containers as absent
+func requireReady(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !metricsReady.Load() {
+			http.Error(w, "metrics not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// reloadHandler re-reads the scrape labels on POST, like SIGHUP does
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := reloadScrapeLabels(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// basicAuth protects the handler with HTTP basic authentication
+func basicAuth(handler http.Handler, user string, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqUser, reqPass, ok := r.BasicAuth()
+		// Compare both values to not reveal which one is wrong through timing
+		userOk := subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(reqPass), []byte(pass)) == 1
+
+		if !ok || !userOk || !passOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func parseLabelMatchers(params []string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, param := range params {
+		key, value, found := strings.Cut(param, "=")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("invalid label filter %q: expected key=value", param))
+		}
+		if !labelNameRegex.MatchString(key) {
+			return nil, errors.New(fmt.Sprintf("invalid label name in filter %q", param))
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+func filterGatherer(gatherer prometheus.Gatherer, matchers map[string]string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+
+		var res []*dto.MetricFamily
+		for _, family := range families {
+			var metrics []*dto.Metric
+			for _, metric := range family.GetMetric() {
+				if metricMatches(metric, matchers) {
+					metrics = append(metrics, metric)
+				}
+			}
+			if len(metrics) == 0 {
+				continue
+			}
+			family.Metric = metrics
+			res = append(res, family)
+		}
+		return res, err
+	})
+}
+
+func metricMatches(metric *dto.Metric, matchers map[string]string) bool {
+	matched := 0
+	for _, pair := range metric.GetLabel() {
+		if value, ok := matchers[pair.GetName()]; ok {
+			if pair.GetValue() != value {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(matchers)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TDaemonHealth holds the result of the last call to each Docker daemon, keyed by host label
+type TDaemonHealth struct {
+	sync.Mutex
+	errs map[string]error
+}
+
+func (h *TDaemonHealth) Set(host string, err error) {
+	h.Lock()
+	if h.errs == nil {
+		h.errs = make(map[string]error)
+	}
+	h.errs[host] = err
+	h.Unlock()
+}
+
+// Get returns the errors of the daemons which were not reachable on the last call
+func (h *TDaemonHealth) Get() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.errs) == 0 {
+		return errors.New("not checked yet")
+	}
+	var failed []string
+	for host, err := range h.errs {
+		if err == nil {
+			continue
+		}
+		if host == "" {
+			failed = append(failed, err.Error())
+		} else {
+			failed = append(failed, host+": "+err.Error())
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return errors.New(strings.Join(failed, "; "))
+}
+
+// Reachable reports whether at least one daemon was reachable on the last call
+func (h *TDaemonHealth) Reachable() bool {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, err := range h.errs {
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+var daemonHealth = new(TDaemonHealth)
+
+// healthzHandler reports 200 when a Docker daemon was reachable on the last call, 503 otherwise.
+// With several daemons the unreachable ones are listed but don't fail the check.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	docker := "ok"
+	if err := daemonHealth.Get(); err != nil {
+		docker = err.Error()
+	}
+	if !daemonHealth.Reachable() {
+		status = http.StatusServiceUnavailable
+	}
+
+	monitored := 0
+	if statsThreads != nil {
+		monitored = statsThreads.Len()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"docker":    docker,
+		"monitored": monitored,
+	})
+}
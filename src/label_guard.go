@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// TLabelGuard limits the length and the cardinality of the scraped container
+// label values, so a huge or unique per container label can't blow up Prometheus
+type TLabelGuard struct {
+	sync.Mutex
+	MaxLength int // max value length in bytes, 0 for unlimited
+	MaxValues int // max distinct values of a label before it is no longer scraped for new containers, 0 for unlimited
+
+	values  map[string]map[string]int    // containers using each value, per label
+	owners  map[string]map[string]string // value of each label, per container
+	skipped map[string]bool              // labels over MaxValues, empty for containers not tracked yet
+	warned  map[string]bool              // truncated labels per container
+}
+
+// Value returns the value to emit for a container label
+func (g *TLabelGuard) Value(containerId string, label string, value string) string {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.MaxLength > 0 && len(value) > g.MaxLength {
+		if key := containerId + "/" + label; !g.warned[key] {
+			if g.warned == nil {
+				g.warned = make(map[string]bool)
+			}
+			g.warned[key] = true
+			slog.Warn("Label value too long, truncated", "container", containerId[0:12], "label", label, "length", len(value), "max", g.MaxLength)
+		}
+		value = truncateLabelValue(value, g.MaxLength)
+	}
+
+	if g.MaxValues > 0 {
+		// Only values of the containers still monitored count, so container churn
+		// doesn't add up to the limit
+		if g.values == nil {
+			g.values = make(map[string]map[string]int)
+			g.owners = make(map[string]map[string]string)
+		}
+		owned := g.owners[containerId]
+		if owned == nil {
+			owned = make(map[string]string)
+			g.owners[containerId] = owned
+		}
+		if current, found := owned[label]; found && current == value {
+			return value
+		} else if found {
+			g.release(label, current)
+			delete(owned, label)
+		}
+		// Containers keep the value they were emitted with, a new empty valued
+		// series next to their existing one would only add series
+		if g.skipped[label] {
+			return ""
+		}
+
+		used := g.values[label]
+		if used == nil {
+			used = make(map[string]int)
+			g.values[label] = used
+		}
+		if used[value] == 0 && len(used) >= g.MaxValues {
+			if g.skipped == nil {
+				g.skipped = make(map[string]bool)
+			}
+			g.skipped[label] = true
+			slog.Warn("Label has too many distinct values, no longer scraped for new containers", "label", label, "max", g.MaxValues)
+			return ""
+		}
+		used[value]++
+		owned[label] = value
+	}
+	return value
+}
+
+// release drops a use of a label value, must be called with the lock held
+func (g *TLabelGuard) release(label string, value string) {
+	used := g.values[label]
+	if used == nil {
+		return
+	}
+	if used[value]--; used[value] <= 0 {
+		delete(used, value)
+	}
+}
+
+// Forget drops the label values and truncation warnings of a removed container
+func (g *TLabelGuard) Forget(containerId string) {
+	g.Lock()
+	defer g.Unlock()
+
+	for label, value := range g.owners[containerId] {
+		g.release(label, value)
+	}
+	delete(g.owners, containerId)
+
+	prefix := containerId + "/"
+	for key := range g.warned {
+		if strings.HasPrefix(key, prefix) {
+			delete(g.warned, key)
+		}
+	}
+}
+
+var labelGuard = new(TLabelGuard)
+
+// truncateLabelValue cuts the value to at most max bytes without splitting a UTF-8 sequence
+func truncateLabelValue(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut]
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+func TestLabelValuesLimitKeepsSeries(t *testing.T) {
+	setGlobal(t, &registry, prometheus.NewRegistry())
+	setGlobal(t, &labelsSpec, "env")
+	setGlobal(t, &scrapeLabels, getLabels(false))
+	setGlobal(t, &labelGuard, &TLabelGuard{MaxValues: 2})
+	initMetrics()
+
+	emit := func(n int) {
+		for i := 0; i < n; i++ {
+			stat := &TContainerStatistic{
+				Id:           fmt.Sprintf("%064x", i+1),
+				Name:         fmt.Sprintf("/app-%d", i+1),
+				Labels:       map[string]string{"env": fmt.Sprintf("env-%d", i+1)},
+				RunningState: "running",
+			}
+			containerStatisticRead(stat)
+		}
+	}
+	series := func() map[string]string {
+		t.Helper()
+		res := make(map[string]string)
+		for _, metric := range gatherFamilies(t)["docker_stats_container_running_stats"].GetMetric() {
+			labels := make(map[string]string)
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if previous, found := res[labels["name"]]; found {
+				t.Errorf("container %s has series with env %q and %q", labels["name"], previous, labels["env"])
+			}
+			res[labels["name"]] = labels["env"]
+		}
+		return res
+	}
+
+	// The third value crosses the limit, later reads add no series
+	emit(3)
+	emit(3)
+
+	expected := map[string]string{"app-1": "env-1", "app-2": "env-2", "app-3": ""}
+	actual := series()
+	if len(actual) != len(expected) {
+		t.Errorf("%d series after the limit was crossed, expected %d: %v", len(actual), len(expected), actual)
+	}
+	for name, env := range expected {
+		if actual[name] != env {
+			t.Errorf("env of %s = %q, expected %q", name, actual[name], env)
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+    "context"
     "errors"
     "fmt"
-    "log"
+    "log/slog"
     "sync"
 )
 
@@ -12,37 +13,46 @@ type TOpt struct {
     Value any
 }
 
+// ThreadList is a set of threads keyed by ID. All methods are safe for concurrent
+// use: the main loop adds and removes threads while monitor goroutines remove
+// themselves when their container is gone.
 type ThreadList struct {
-    sync.Mutex
+    sync.RWMutex
     items map[string]TThread
 }
 
 func (t *ThreadList) Exists(key string) bool {
+    t.RLock()
     _, found := t.items[key]
+    t.RUnlock()
     return found
 }
 
 func (t *ThreadList) Get(key string) (TThread, bool) {
-    t.Lock()
+    t.RLock()
     item, found := t.items[key]
-    t.Unlock()
+    t.RUnlock()
     return item, found
 }
 
+// GetKeys returns a snapshot of the keys, which stays valid while items are
+// added or removed by other goroutines
 func (t *ThreadList) GetKeys() []string {
-    var res []string
-    if t.items == nil {
-        return res
-    }
-
-    t.Lock()
-    for key, _ := range t.items {
+    t.RLock()
+    res := make([]string, 0, len(t.items))
+    for key := range t.items {
         res = append(res, key)
     }
-    t.Unlock()
+    t.RUnlock()
     return res
 }
 
+func (t *ThreadList) Len() int {
+    t.RLock()
+    defer t.RUnlock()
+    return len(t.items)
+}
+
 func (t *ThreadList) Put(key string, item TThread) error {
     t.Lock()
     defer t.Unlock()
@@ -65,16 +75,47 @@ func (t *ThreadList) Del(key string) {
     t.Unlock()
 }
 
-func (t *ThreadList) StopAll() {
-    t.Lock()
-    defer t.Unlock()
+// StopAll stops every thread and waits until all of them have finished or ctx
+// is done.
+func (t *ThreadList) StopAll(ctx context.Context) error {
+    return t.StopKeys(ctx, t.GetKeys())
+}
 
-    if t.items == nil {
-        return
+// StopKeys stops the threads of the given keys and waits until all of them have
+// finished or ctx is done. Unknown keys are ignored. The threads are stopped
+// outside of the lock, so a thread removing itself from the list on stop
+// doesn't deadlock.
+func (t *ThreadList) StopKeys(ctx context.Context, keys []string) error {
+    t.RLock()
+    items := make(map[string]TThread, len(keys))
+    for _, key := range keys {
+        if item, found := t.items[key]; found {
+            items[key] = item
+        }
     }
-    for key, item := range t.items {
+    t.RUnlock()
+
+    var wg sync.WaitGroup
+    for key, item := range items {
         if er := item.Stop(); er != nil {
-            log.Println("Error stopping thread:", key, er)
+            slog.Error("Error stopping thread", "key", key, "err", er)
+            continue
         }
+        // Not running yet, a thread stopped before Exec doesn't start
+        done := item.Done()
+        if done == nil {
+            continue
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            select {
+            case <-done:
+            case <-ctx.Done():
+            }
+        }()
     }
+    wg.Wait()
+
+    return ctx.Err()
 }
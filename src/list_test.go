@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closedChannel is the Done channel of fake threads, which finish at once
+var closedChannel = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// TFakeThread is a thread which only records being stopped
+type TFakeThread struct {
+	stopped atomic.Bool
+}
+
+func (f *TFakeThread) Exec() error              { return nil }
+func (f *TFakeThread) Stop() error              { f.stopped.Store(true); return nil }
+func (f *TFakeThread) Done() <-chan struct{}    { return closedChannel }
+func (f *TFakeThread) SetOpt(opt TOpt) error    { return nil }
+func (f *TFakeThread) GetOpt(name string) *TOpt { return nil }
+
+func TestThreadListStopKeys(t *testing.T) {
+	list := new(ThreadList)
+	removed, kept := new(TFakeThread), new(TFakeThread)
+	if err := list.Put("removed", removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Put("kept", kept); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the threads of the removed containers are stopped
+	if err := list.StopKeys(context.Background(), []string{"removed", "unknown"}); err != nil {
+		t.Errorf("StopKeys() = %v, expected no error", err)
+	}
+	if !removed.stopped.Load() {
+		t.Error("thread of a removed container was not stopped")
+	}
+	if kept.stopped.Load() {
+		t.Error("thread of a kept container was stopped")
+	}
+}
+
+func TestThreadListConcurrentUse(t *testing.T) {
+	list := new(ThreadList)
+
+	// Threads are added and removed by the main loop while others remove
+	// themselves and shutdown stops them all
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("thread-%d", i)
+			if err := list.Put(key, new(TFakeThread)); err != nil {
+				t.Error(err)
+				return
+			}
+			for _, other := range list.GetKeys() {
+				if thread, found := list.Get(other); found {
+					_ = thread.GetOpt("name")
+				}
+			}
+			if i%2 == 0 {
+				_ = list.StopKeys(context.Background(), []string{key})
+				list.Del(key)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = list.StopAll(context.Background())
+	}()
+	wg.Wait()
+
+	if n := list.Len(); n != 10 {
+		t.Errorf("%d threads listed, expected 10", n)
+	}
+}
+
+func TestThreadListConcurrentMonitors(t *testing.T) {
+	initTestMetrics(t)
+	setGlobal(t, &statsThreads, new(ThreadList))
+
+	// Monitors are added and removed by the main loop while others remove
+	// themselves and shutdown stops them all
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id := fmt.Sprintf("%064x", i+1)
+			cli := &TStreamsClient{TFakeDockerClient: newFakeClient(""), Streams: []TFakeStream{{Frames: strings.Repeat(testStatsFrame, 3)}}}
+			cli.Container.ID = id
+			if i%4 == 0 {
+				cli.Streams[0].End = io.EOF // container gone, the monitor removes itself
+			}
+
+			mon := new(TContainerMonitor)
+			mon.Id = id
+			mon.Cli = cli
+			mon.Interval = time.Millisecond
+			mon.StallTimeout = time.Minute
+			mon.OnRemove = new(TDockerEndpoint).containerStopped
+			if err := statsThreads.Put(id, mon); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := mon.Exec(); err != nil {
+				t.Error(err)
+				return
+			}
+
+			for _, key := range statsThreads.GetKeys() {
+				if thread, found := statsThreads.Get(key); found {
+					_ = thread.GetOpt("name")
+				}
+			}
+			if i%4 == 1 {
+				_ = mon.Stop()
+				statsThreads.Del(id)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = statsThreads.StopAll(ctx)
+	}()
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := statsThreads.StopAll(ctx); err != nil {
+		t.Fatalf("monitors did not stop: %v", err)
+	}
+	if n := statsThreads.Len(); n != 0 {
+		t.Errorf("%d monitors still listed after stopping all, expected none", n)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogger installs the default logger for the given level (debug, info,
+// warn, error) and format (text, json)
+func setupLogger(level string, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return errors.New(fmt.Sprintf("invalid log level %q", level))
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return errors.New(fmt.Sprintf("invalid log format %q", format))
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs the message at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
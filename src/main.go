@@ -2,128 +2,305 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
-	RefreshContainersListInterval = 2 * time.Second // TODO: make it configurable
-	RefreshContainersTickInterval = 1 * time.Second
+	RefreshContainersListInterval = 2 * time.Second // default of -list-interval
+	RefreshContainersTickInterval = 1 * time.Second // default of -tick-interval
+
+	MaxContainersListBackoff = 30 * time.Second // max retry delay when docker daemon is unreachable
 )
 
-const (
-	metricNameSpace    = "docker_stats"
-	metricSubContainer = "container"
+// Build information, set with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = "unknown"
 )
 
 var httpServer *http.Server
 var statsThreads *ThreadList
+var webhook *TWebhookNotifier
 
-var labelRegex = regexp.MustCompile("[\\W-]")
-var scrapeLabels []string
-
-var registry *prometheus.Registry
-var containersCount *prometheus.GaugeVec
-
-var memUsageVec *prometheus.GaugeVec
-var memLimitVec *prometheus.GaugeVec
-
-var cpuUsageTotalVec *prometheus.GaugeVec
-var cpuPercentage *prometheus.GaugeVec
+func main() {
+	chStop := make(chan os.Signal, 1)
+	signal.Notify(chStop, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-var runningStats *prometheus.GaugeVec
+	chReload := make(chan os.Signal, 1)
+	signal.Notify(chReload, syscall.SIGHUP)
 
-// Docker API Client
-var cli *client.Client
+	chDump := make(chan os.Signal, 1)
+	signal.Notify(chDump, syscall.SIGUSR1)
 
-func getLabels(normalize bool) []string {
-	labels := strings.Split(strings.TrimSpace(os.Getenv("DOCKER_STATS_LABELS_SCRAPE")), ",")
+	// Scrape Handler
+	defaultHttpPort := flag.Int("port", 9099, "Port number to listen on for metrics")
+	listenAddress := flag.String("listen-address", "", "Address to listen on for metrics, e.g. 127.0.0.1:9099, takes precedence over -port")
+	flag.IntVar(&labelGuard.MaxLength, "max-label-length", 256, "Max length of scraped container label values, longer ones are truncated (0 for unlimited)")
+	flag.IntVar(&labelGuard.MaxValues, "max-label-values", 1000, "Max distinct values of a scraped container label, labels with more are no longer scraped for new containers (0 for unlimited)")
+	unixSocket := flag.String("unix-socket", "", "Unix socket path to serve metrics on instead of the TCP port")
+	readHeaderTimeout := flag.Duration("http-read-header-timeout", 10*time.Second, "Max time to read the request headers of a scrape")
+	readTimeout := flag.Duration("http-read-timeout", 30*time.Second, "Max time to read a whole scrape request")
+	writeTimeout := flag.Duration("http-write-timeout", 30*time.Second, "Max time to write a scrape response")
+	idleTimeout := flag.Duration("http-idle-timeout", 120*time.Second, "Max time to keep an idle keep-alive connection open")
+	webhookUrl := flag.String("webhook-url", "", "URL to POST container state changes to (disabled when empty)")
+	webhookQueueSize := flag.Int("webhook-queue-size", 100, "Max number of pending webhook notifications, extra ones are dropped")
+	startupConcurrency := flag.Int("startup-concurrency", 16, "Max number of container monitors started in parallel on startup")
+	flag.IntVar(&readScheduler.Slots, "max-parallel-reads", 0, "Max number of container statistics read at once, the containers read longest ago go first when more are due (0 = no limit)")
+	flag.IntVar(&maxMonitored, "max-monitored", 0, "Max number of monitored containers, new containers are skipped above it (0 = no limit)")
+	flag.StringVar(&labelsFile, "labels-file", "", "File listing container labels to scrape, re-read on SIGHUP and POST /reload (env DOCKER_STATS_LABELS_FILE, overrides DOCKER_STATS_LABELS_SCRAPE)")
+	flag.IntVar(&statsBufferSize, "stats-buffer-size", DefaultStatsBufferSize, "Size in bytes of the read buffer of a container statistic stream")
+	stallTimeout := flag.Duration("stall-timeout", 0, "Max time without a statistic read from a container before its monitor is restarted (default 3 tick intervals, at least 3s)")
+	networkExcludePattern := flag.String("network-exclude-interfaces", "^lo$", "Regular expression of network interfaces not to expose (empty to expose all)")
+	flag.BoolVar(&networkAggregate, "network-aggregate", false, "Sum up the network interfaces of a container into series without the interface label")
+	flag.DurationVar(&fsSizeInterval, "fs-size-interval", 0, "Interval of reading container filesystem sizes, e.g. 5m (0 = disabled). Computing sizes is expensive and increases the Docker daemon load")
+	flag.BoolVar(&dnsInfoEnabled, "dns-info", false, "Expose configured DNS servers and extra hosts of containers as info metrics")
+	singleContainer := flag.String("container", "", "ID or name of a single container to monitor, bypassing the container list; exits once the container is removed")
+	textfileOutput := flag.String("textfile-output", "", "File to write the metrics to periodically in the format of the node exporter textfile collector (disabled when empty)")
+	textfileInterval := flag.Duration("textfile-interval", 15*time.Second, "Interval of writing -textfile-output")
+	textfileOnly := flag.Bool("textfile-only", false, "Only write -textfile-output, without serving metrics over HTTP")
+	dryRun := flag.Bool("dry-run", false, "List the containers which would be monitored with their labels and exit")
+	selfTest := flag.Bool("selftest", false, "Run the pipeline against a fake container, verify emitted metrics and exit")
+	listInterval := flag.Duration("list-interval", RefreshContainersListInterval, "Interval of container list refresh (env DOCKER_STATS_LIST_INTERVAL)")
+	tickInterval := flag.Duration("tick-interval", RefreshContainersTickInterval, "Interval of container statistic reads (env DOCKER_STATS_TICK_INTERVAL)")
+	excludeSelfContainer := flag.Bool("exclude-self", true, "Don't monitor the container the exporter runs in, detected from its cgroup, mounts or host name")
+	scrapeLabel := flag.String("scrape-label", "", "Monitor only containers carrying this label, as key or key=value, e.g. prometheus.scrape=true (disabled when empty)")
+	flag.StringVar(&nameLabel, "name-label", "", "Container label whose value replaces the name label of the container metrics when present, e.g. monitoring.rename (disabled when empty)")
+	flag.BoolVar(&nodeLabel, "node-label", false, "Add a node label with the name of the Docker daemon host to all metrics (env DOCKER_STATS_NODE_LABEL)")
+	flag.StringVar(&nodeName, "node-name", "", "Value of the node label instead of the name reported by the Docker daemon, implies -node-label (env DOCKER_STATS_NODE_NAME)")
+	flag.BoolVar(&composeLabels, "compose-labels", false, "Add compose_project and compose_service labels from the Docker Compose labels of containers (env DOCKER_STATS_COMPOSE_LABELS)")
+	flag.BoolVar(&imageLabels, "image-labels", false, "Add image and image_id labels to container metrics, image IDs change with every build (env DOCKER_STATS_IMAGE_LABELS)")
+	flag.BoolVar(&noIdLabel, "no-id-label", false, "Omit the container ID label from metrics (env DOCKER_STATS_NO_ID)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, serve metrics over HTTPS when set with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificate file to verify scraper client certificates (mutual TLS)")
+	authUser := flag.String("auth-user", "", "User name for basic auth of /metrics, /stats.json and /reload (env DOCKER_STATS_AUTH_USER)")
+	authPass := flag.String("auth-pass", "", "Password for basic auth of /metrics, /stats.json and /reload (env DOCKER_STATS_AUTH_PASS)")
+	inspectEvery := flag.Int("inspect-every", DefaultInspectEvery, "Number of statistic reads between two container inspects, the container state lags at most this many tick intervals (env DOCKER_STATS_INSPECT_EVERY)")
+	dockerHost := flag.String("docker-host", "", "Docker daemon address overriding DOCKER_HOST, e.g. tcp://10.0.0.5:2376")
+	flag.StringVar(&apiVersion, "api-version", "", "Docker API version to use, e.g. 1.41 (default: negotiated with the daemon, or DOCKER_API_VERSION)")
+	dockerHosts := flag.String("docker-hosts", "", "Comma separated Docker daemon addresses to monitor, adds a host label to container metrics")
+	enableMetrics := flag.String("enable-metrics", strings.Join(metricGroups, ","), "Comma separated container metric groups to expose, state metrics are always exposed (env DOCKER_STATS_ENABLE_METRICS)")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error (env DOCKER_STATS_LOG_LEVEL)")
+	logFormat := flag.String("log-format", "text", "Log format: text or json (env DOCKER_STATS_LOG_FORMAT)")
+	platform := flag.String("platform", "", "OS of the monitored containers used for the CPU percentage: linux or windows, detected from the daemon when empty")
+	flag.BoolVar(&pullMode, "pull-mode", false, "Read container statistics when metrics are scraped instead of streaming them: far less load with many idle containers, but scrapes take 1-2 seconds")
+	stateMappingSpec := flag.String("state-mapping", "detailed", "Values of running_stats by container state: detailed, binary (running=1, others 0) or state=value pairs, e.g. running=1,exited=0")
+	flag.StringVar(&stateMetrics, "state-metrics", "numeric", "Container state metrics: numeric (running_stats), enum (state gauge with a state label) or both")
+	flag.StringVar(&compatMode, "compat", "", "Also expose CPU, memory, network and blkio metrics under the names of another exporter: cadvisor (container_cpu_usage_seconds_total, container_memory_usage_bytes, ...)")
+	flag.StringVar(&pausedCPU, "paused-cpu", "hold", "CPU usage of paused containers: hold (keep the usage before the pause) or absent")
+	flag.StringVar(&cpuUnit, "cpu-unit", "percent", "Unit of the CPU usage metric: percent (cpu_pcnt) or cores (cpu_cores)")
+	flag.DurationVar(&staleAfter, "stale-after", 0, "Omit the series of containers without a statistic read for this long, so they go stale in Prometheus (0 to always expose them)")
+	flag.BoolVar(&statsTimestamps, "use-stats-timestamp", false, "Expose container samples with the time docker read their statistic instead of the scrape time, ignored in pull mode")
+	pullTimeout := flag.Duration("pull-timeout", 10*time.Second, "Max time to read the containers of a scrape in pull mode")
+	configFile := flag.String("config", "", "JSON config file, its settings apply when not given as flags or environment variables")
+	listAll := flag.Bool("all", false, "Monitor all containers including stopped ones (env DOCKER_STATS_ALL)")
+	flag.Parse()
 
-	var res []string
-	for _, lbl := range labels {
-		if lbl == "" {
-			continue
+	if er := applyEnvOverrides(); er != nil {
+		log.Fatal("Configuration error: ", er)
+	}
+	if *configFile != "" {
+		if er := applyConfigFile(*configFile); er != nil {
+			log.Fatal("Configuration error: ", er)
 		}
-
-		if normalize {
-			res = append(res, labelRegex.ReplaceAllLiteralString(lbl, "_"))
+	}
+	if er := setupLogger(*logLevel, *logFormat); er != nil {
+		log.Fatal("Configuration error: ", er)
+	}
+	if *listInterval <= 0 || *tickInterval <= 0 {
+		fatal("Configuration error: list and tick intervals must be greater than 0")
+	}
+	enabledMetrics = parseEnabledMetrics(*enableMetrics)
+	if mapping, er := parseStateMapping(*stateMappingSpec); er != nil {
+		fatal("Configuration error: invalid -state-mapping", "err", er)
+	} else {
+		stateMapping = mapping
+	}
+	if *platform != "" && *platform != "linux" && *platform != "windows" {
+		fatal("Configuration error: -platform must be linux or windows")
+	}
+	if *defaultHttpPort <= 0 || *defaultHttpPort > 65535 {
+		fatal("Configuration error: port must be between 1 and 65535")
+	}
+	if er := validateListenAddress(*listenAddress); er != nil {
+		fatal("Configuration error: invalid -listen-address", "err", er)
+	}
+	if statsBufferSize < 4096 {
+		fatal("Configuration error: -stats-buffer-size must be at least 4096")
+	}
+	if key, _, _ := strings.Cut(*scrapeLabel, "="); *scrapeLabel != "" && strings.TrimSpace(key) == "" {
+		fatal("Configuration error: -scrape-label must start with a label key")
+	}
+	if nodeName != "" {
+		nodeLabel = true
+	}
+	if *textfileInterval <= 0 {
+		fatal("Configuration error: -textfile-interval must be greater than 0")
+	}
+	if *textfileOnly && *textfileOutput == "" {
+		fatal("Configuration error: -textfile-only requires -textfile-output")
+	}
+	if *readHeaderTimeout <= 0 || *readTimeout <= 0 || *writeTimeout <= 0 || *idleTimeout <= 0 {
+		fatal("Configuration error: HTTP timeouts must be greater than 0")
+	}
+	if labelGuard.MaxLength < 0 || labelGuard.MaxValues < 0 {
+		fatal("Configuration error: label limits must not be negative")
+	}
+	if readScheduler.Slots < 0 {
+		fatal("Configuration error: max parallel reads must not be negative")
+	}
+	if stateMetrics != "numeric" && stateMetrics != "enum" && stateMetrics != "both" {
+		fatal("Configuration error: -state-metrics must be numeric, enum or both")
+	}
+	if compatMode != "" && compatMode != "cadvisor" {
+		fatal("Configuration error: -compat must be cadvisor")
+	}
+	if pausedCPU != "hold" && pausedCPU != "absent" {
+		fatal("Configuration error: -paused-cpu must be hold or absent")
+	}
+	if cpuUnit != "percent" && cpuUnit != "cores" {
+		fatal("Configuration error: -cpu-unit must be percent or cores")
+	}
+	if staleAfter < 0 {
+		fatal("Configuration error: -stale-after must not be negative")
+	}
+	if *pullTimeout <= 0 {
+		fatal("Configuration error: pull timeout must be greater than 0")
+	}
+	if *inspectEvery <= 0 {
+		fatal("Configuration error: inspect every must be greater than 0")
+	}
+	if *startupConcurrency <= 0 {
+		fatal("Configuration error: startup concurrency must be greater than 0")
+	}
+	if *networkExcludePattern != "" {
+		if re, er := regexp.Compile(*networkExcludePattern); er != nil {
+			fatal("Configuration error: invalid -network-exclude-interfaces regular expression", "err", er)
 		} else {
-			res = append(res, lbl)
+			networkExclude = re
 		}
 	}
+	if *stallTimeout < 0 {
+		fatal("Configuration error: stall timeout must not be negative")
+	}
+	if fsSizeInterval < 0 {
+		fatal("Configuration error: fs size interval must not be negative")
+	}
+	if maxMonitored < 0 {
+		fatal("Configuration error: max monitored must not be negative")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("Configuration error: -tls-cert and -tls-key must be set together")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		fatal("Configuration error: -tls-client-ca requires -tls-cert and -tls-key")
+	}
+	if (*authUser == "") != (*authPass == "") {
+		fatal("Configuration error: -auth-user and -auth-pass must be set together")
+	}
 
-	// TODO: optionally exclude ID from list
-	res = append([]string{"id", "name"}, res...)
-
-	return res
-}
-
-func getContainerVector(name string, description string, labels []string) *prometheus.GaugeVec {
-	return prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: metricNameSpace,
-			Subsystem: metricSubContainer,
-			Name:      name,
-			Help:      description,
-		},
-		labels,
-	)
-}
+	if *singleContainer != "" && (pullMode || *dockerHosts != "") {
+		fatal("Configuration error: -container can not be combined with -pull-mode or -docker-hosts")
+	}
+	if *dockerHost != "" && *dockerHosts != "" {
+		fatal("Configuration error: -docker-host and -docker-hosts are mutually exclusive")
+	}
+	hosts := []string{*dockerHost}
+	if *dockerHosts != "" {
+		hosts = splitHosts(*dockerHosts)
+		hostLabel = true
+	}
+	if len(hosts) == 0 {
+		fatal("Configuration error: -docker-hosts contains no address")
+	}
 
-func main() {
-	chStop := make(chan os.Signal, 1)
-	signal.Notify(chStop, os.Interrupt, os.Kill, syscall.SIGTERM)
+	if *selfTest {
+		os.Exit(runSelfTest())
+	}
 
-	// Scrape Handler
-	defaultHttpPort := flag.Int("port", 9099, "Port number to listen on for metrics")
-	flag.Parse()
 	registry = prometheus.NewRegistry()
-	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	handler := requireReady(metricsHandler(registry, promhttp.HandlerOpts{}))
+	var jsonHandler http.Handler = http.HandlerFunc(statsJsonHandler)
+	var reload http.Handler = http.HandlerFunc(reloadHandler)
+	if *authUser != "" {
+		handler = basicAuth(handler, *authUser, *authPass)
+		jsonHandler = basicAuth(jsonHandler, *authUser, *authPass)
+		reload = basicAuth(reload, *authUser, *authPass)
+	}
 	http.Handle("/metrics", handler)
+	http.Handle("/stats.json", jsonHandler)
+	http.Handle("/reload", reload)
+	http.HandleFunc("/healthz", healthzHandler)
+	address := fmt.Sprintf(":%d", *defaultHttpPort)
+	if *listenAddress != "" {
+		address = *listenAddress
+	}
 	httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", *defaultHttpPort),
-		Handler: nil,
+		Addr:              address,
+		Handler:           nil,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
 	}
-
-	go func(srv *http.Server) {
-		log.Println("Start scrape server on port:", *defaultHttpPort)
-		if sErr := srv.ListenAndServe(); sErr != nil {
-			log.Fatal("Can not start http server:", sErr)
+	if *tlsClientCA != "" {
+		if tlsConfig, er := newClientAuthTLSConfig(*tlsClientCA); er != nil {
+			fatal("Can not load TLS client CA", "err", er)
+		} else {
+			httpServer.TLSConfig = tlsConfig
 		}
-	}(httpServer)
-
-	// Init master docker API client
-	if c, err := client.NewClientWithOpts(client.FromEnv); err != nil {
-		panic(err)
-	} else {
-		cli = c
-		log.Println("[INFO] Docker Client version:", cli.ClientVersion())
+	}
 
-		if version, er := cli.ServerVersion(context.Background()); er != nil {
-			log.Println("Error getting server version:", er)
-		} else {
-			log.Println("[INFO] Docker Server Version:", version.Version, "(", version.APIVersion, ")")
+	if !*dryRun && !*textfileOnly {
+		listener, er := listenMetrics(httpServer.Addr, *unixSocket)
+		if er != nil {
+			fatal("Can not listen for scrapes", "err", er)
 		}
+		go func(srv *http.Server) {
+			slog.Info("Start scrape server", "address", listener.Addr().String())
+			if sErr := serveMetrics(srv, listener, *tlsCert, *tlsKey); sErr != nil {
+				fatal("Can not start http server", "err", sErr)
+			}
+		}(httpServer)
 	}
 
 	statsThreads = new(ThreadList)
+	if spec, er := loadLabelsSpec(); er != nil {
+		fatal("Can not read scrape labels", "err", er)
+	} else {
+		labelsSpec = spec
+	}
 	scrapeLabels = getLabels(false)
 	initMetrics()
 
-	var updTime time.Time
+	if *webhookUrl != "" && !*dryRun {
+		webhook = new(TWebhookNotifier)
+		webhook.Url = *webhookUrl
+		webhook.QueueSize = *webhookQueueSize
+		webhook.Dropped = webhookDropped
+		if er := webhook.Exec(); er != nil {
+			fatal("Can not start webhook notifier", "err", er)
+		}
+		slog.Info("Send container state changes to webhook", "url", *webhookUrl)
+	}
 
 	// Process container filters
 	containersFilter := filters.NewArgs()
@@ -132,221 +309,284 @@ func main() {
 		if label == "" {
 			continue
 		}
-		log.Println("Filter containers by label:", label)
+		slog.Info("Filter containers by label", "label", label)
 		containersFilter.Add("label", label)
 	}
+	if *scrapeLabel != "" {
+		// Filtered by the daemon like the filter labels, unmarked containers are never listed
+		slog.Info("Monitor only containers with the scrape label", "label", *scrapeLabel)
+		containersFilter.Add("label", *scrapeLabel)
+	}
 
-	for {
-		select {
-		case <-chStop:
-			stopProgram()
-			return
-		default:
+	var excludeLabels []string
+	for _, label := range strings.Split(os.Getenv("DOCKER_STATS_EXCLUDE_LABELS"), " ") {
+		if label == "" {
+			continue
 		}
+		slog.Info("Exclude containers by label", "label", label)
+		excludeLabels = append(excludeLabels, label)
+	}
 
-		if time.Since(updTime) <= RefreshContainersListInterval {
-			time.Sleep(RefreshContainersTickInterval)
-			continue
+	if *excludeSelfContainer {
+		if selfContainerId = detectSelfContainerId(); selfContainerId != "" {
+			slog.Info("Exclude the exporter container", "container", selfContainerId[0:12])
 		}
-		updTime = time.Now()
-
-		containerList, err := cli.ContainerList(context.Background(), container.ListOptions{
-			All:     false,
-			Filters: containersFilter,
-		})
-		if err != nil {
-			panic(fmt.Sprintf("Error getting container list: %s", err))
+	}
+
+	var nameFilter *regexp.Regexp
+	if pattern := os.Getenv("DOCKER_STATS_FILTER_NAME"); pattern != "" {
+		if re, er := regexp.Compile(pattern); er != nil {
+			fatal("Invalid DOCKER_STATS_FILTER_NAME regular expression", "err", er)
+		} else {
+			nameFilter = re
 		}
+		slog.Info("Filter containers by name", "pattern", pattern)
+	}
 
-		containersCount.With(prometheus.Labels{}).Set(float64(len(containerList)))
+	endpoints := make([]*TDockerEndpoint, 0, len(hosts))
+	for _, host := range hosts {
+		ep := new(TDockerEndpoint)
+		ep.Host = host
+		ep.Platform = *platform
+		if hostLabel {
+			ep.Label = host
+		}
+		ep.ListInterval = *listInterval
+		ep.TickInterval = *tickInterval
+		ep.InspectEvery = *inspectEvery
+		ep.StallTimeout = *stallTimeout
+		ep.FsSizeInterval = fsSizeInterval
+		ep.StartupConcurrency = *startupConcurrency
+		ep.ListAll = *listAll
+		ep.Filters = containersFilter
+		ep.NameFilter = nameFilter
+		ep.ExcludeLabels = excludeLabels
+
+		if er := ep.connect(); er != nil {
+			fatal("Can not create Docker client", "host", host, "err", er)
+		}
+		endpoints = append(endpoints, ep)
 
-		for _, cont := range containerList {
-			if statsThreads.Exists(cont.ID) {
-				continue
-			}
+		// Connecting to an unreachable daemon takes a while, don't make a stop wait for the others
+		if stopRequested(chStop) {
+			stopProgram()
+			return
+		}
+	}
 
-			mon := new(TContainerMonitor)
-			mon.Id = cont.ID
-			mon.OnStatRead = containerStatisticRead
-			mon.OnRemove = containerStopped
+	if *dryRun {
+		os.Exit(runDryRun(endpoints))
+	}
 
-			if e := mon.Exec(); e != nil {
-				log.Println("Error executing container monitor:", e)
-				continue
-			}
-			if e := statsThreads.Put(cont.ID, mon); e != nil {
-				log.Println("Error adding thread to list: ", e)
-			}
-			log.Println("Start monitoring for container:", cont.ID[0:12])
+	// Poll every daemon independently, so an unreachable one doesn't block the others
+	ctx, cancel := context.WithCancel(context.Background())
+	var pollers sync.WaitGroup
+	var singleDone <-chan struct{} // never ready unless a single container is monitored
+	if *singleContainer != "" {
+		done, er := endpoints[0].monitorSingle(ctx, *singleContainer)
+		if er != nil {
+			fatal("Can not monitor container", "container", *singleContainer, "err", er)
 		}
-		// Stop monitoring removed containers
-		for _, key := range statsThreads.GetKeys() {
-			present := false
-			for _, cont := range containerList {
-				if cont.ID == key {
-					present = true
-					break
-				}
-			}
-			if !present {
-				if th, found := statsThreads.Get(key); found {
-					if er := th.Stop(); er != nil {
-						log.Println("Error stopping container monitor:", er)
-					}
-				}
-			}
+		singleDone = done
+		metricsReady.Store(true)
+	} else if pullMode {
+		collector := new(TPullCollector)
+		collector.Endpoints = endpoints
+		collector.Timeout = *pullTimeout
+		registry.MustRegister(collector)
+		metricsReady.Store(true) // a scrape reads the containers itself
+		slog.Info("Read container statistics on scrape")
+	} else {
+		// Ready once every daemon has been listed, or failed to, for the first time
+		var firstCycle sync.WaitGroup
+		firstCycle.Add(len(endpoints))
+		go func() {
+			firstCycle.Wait()
+			metricsReady.Store(true)
+			slog.Info("First monitoring cycle complete, serving metrics")
+		}()
+
+		for _, ep := range endpoints {
+			ep.OnFirstCycle = firstCycle.Done
+			pollers.Add(1)
+			go func(ep *TDockerEndpoint) {
+				defer pollers.Done()
+				ep.poll(ctx)
+			}(ep)
 		}
 	}
-}
-
-func stopProgram() {
-	statsThreads.StopAll()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Fatal("Can not gracefully stop metrics server:", err)
+	if stopRequested(chStop) {
+		cancel()
+		pollers.Wait()
+		stopProgram()
+		return
 	}
 
-	return
-}
-
-func initMetrics() {
-	labels := getLabels(true)
-
-	containersCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: metricNameSpace,
-			Subsystem: metricSubContainer,
-			Name:      "count",
-			Help:      "Count of running containers",
-		},
-		[]string{},
-	)
-	registry.MustRegister(containersCount)
-
-	memUsageVec = getContainerVector("memory_usage", "Actual value of memory usage by container", labels)
-	registry.MustRegister(memUsageVec)
-
-	memLimitVec = getContainerVector("memory_limit", "The limit of memory container can use", labels)
-	registry.MustRegister(memLimitVec)
-
-	cpuUsageTotalVec = getContainerVector("cpu_total", "CPU Usage Total", labels)
-	registry.MustRegister(cpuUsageTotalVec)
+	if *textfileOutput != "" {
+		slog.Info("Write metrics textfile", "path", *textfileOutput, "interval", *textfileInterval)
+		go runTextfileOutput(ctx, registry, *textfileOutput, *textfileInterval)
+	}
 
-	cpuPercentage = getContainerVector("cpu_pcnt", "CPU Usage percentage", labels)
-	registry.MustRegister(cpuPercentage)
+	ticker := time.NewTicker(*listInterval)
+	defer ticker.Stop()
 
-	runningStats = getContainerVector("running_stats", "Numeric representation of container state: 0=created, 1=running, 2=paused, 3=restarting, 4=removing, 5=exited, 6=dead, -1=unknown", labels)
-	registry.MustRegister(runningStats)
+	for {
+		select {
+		case <-chStop:
+			cancel()
+			pollers.Wait()
+			stopProgram()
+			return
+		case <-singleDone:
+			slog.Info("Monitored container is gone, exiting", "container", *singleContainer)
+			cancel()
+			stopProgram()
+			return
+		case <-chReload:
+			if er := reloadScrapeLabels(); er != nil {
+				slog.Error("Error reloading scrape labels", "err", er)
+			}
+		case <-chDump:
+			dumpMonitors()
+		case <-ticker.C:
+			updateRuntimeMetrics()
+			updateStaleness()
+		}
+	}
 }
 
-func containerStatisticRead(stat *TContainerStatistic) {
-	labels := make(map[string]string)
-	for _, labelName := range scrapeLabels {
-		if labelName == "id" {
-			labels["id"] = stat.Id[0:12]
-			continue
-		}
-		if labelName == "name" {
-			labels["name"] = strings.Replace(stat.Name, "/", "", 1) // remove leading slash
+// dumpMonitors logs the state of every container monitor, see SIGUSR1. A monitor
+// is stalled when its goroutine runs but no statistic was read within its stall timeout.
+func dumpMonitors() {
+	keys := statsThreads.GetKeys()
+	sort.Strings(keys)
+
+	slog.Info("Container monitors", "count", len(keys))
+	for _, key := range keys {
+		th, found := statsThreads.Get(key)
+		if !found {
 			continue
 		}
 
-		promLabel := labelRegex.ReplaceAllLiteralString(labelName, "_")
+		name := th.GetOpt("name").Value.(string)
+		alive := th.GetOpt("alive").Value.(bool)
+		lastRead := th.GetOpt("last_read").Value.(time.Time)
+		stallTimeout := th.GetOpt("stall_timeout").Value.(time.Duration)
+		age := time.Since(lastRead)
 
-		if _, ok := stat.Labels[labelName]; ok {
-			labels[promLabel] = stat.Labels[labelName]
-		} else {
-			labels[promLabel] = ""
-		}
+		slog.Info("Container monitor", "key", key, "name", normalizeContainerName(name), "alive", alive,
+			"last_read", lastRead.Format(time.RFC3339), "last_read_age", age.Round(time.Millisecond),
+			"stalled", alive && stallTimeout > 0 && age > stallTimeout)
 	}
-
-	memUsageVec.With(labels).Set(float64(stat.MemoryStats.Usage))
-	memLimitVec.With(labels).Set(float64(stat.MemoryStats.Limit))
-	cpuUsageTotalVec.With(labels).Set(float64(stat.CPUStats.CPUUsage.TotalUsage))
-	cpuPercentage.With(labels).Set(calculateCPUPercentUnix(stat))
-	runningStats.With(labels).Set(stateToValue(stat.RunningState))
 }
 
-func containerStopped(containerId string) {
-	log.Println("Stop container monitoring:", containerId[0:12])
+// Docker API version pinned by -api-version, negotiated with each daemon when empty
+var apiVersion string
 
-	thread, found := statsThreads.Get(containerId)
-	if !found {
-		log.Println("Container with ID is not monitored:", containerId)
-		return
+// newDockerClient creates a Docker API client configured from the environment,
+// connecting to host instead of DOCKER_HOST when given. The API version is
+// negotiated with the daemon unless pinned by -api-version or DOCKER_API_VERSION.
+func newDockerClient(host string) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if apiVersion != "" {
+		opts = append(opts, client.WithVersion(apiVersion))
 	}
-	// Stop and remove container monitor
-	if er := thread.Stop(); er != nil {
-		log.Println("Error stopping container monitor:", containerId, er)
+	if host != "" {
+		if _, err := client.ParseHostURL(host); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid docker host %q: %s", host, err))
+		}
+		opts = append(opts, client.WithHost(host))
 	}
-	statsThreads.Del(containerId)
+	return client.NewClientWithOpts(opts...)
+}
 
-	// Clear container metrics
-	name := thread.GetOpt("name")
-	labels := prometheus.Labels{
-		"id":   containerId[0:12],
-		"name": strings.Replace(name.Value.(string), "/", "", 1),
+// filterContainersByName keeps containers having a name matching the pattern
+func filterContainersByName(list []types.Container, pattern *regexp.Regexp) []types.Container {
+	var res []types.Container
+	for _, cont := range list {
+		for _, name := range cont.Names {
+			if pattern.MatchString(normalizeContainerName(name)) {
+				res = append(res, cont)
+				break
+			}
+		}
 	}
-
-	deleteLabeledMetric(labels,
-		memUsageVec,
-		memLimitVec,
-		cpuUsageTotalVec,
-		cpuPercentage,
-		runningStats,
-	)
+	return res
 }
 
-func deleteLabeledMetric(labels prometheus.Labels, vectors ...*prometheus.GaugeVec) {
-
-	for _, vector := range vectors {
-		if vector == nil {
-			continue
+// excludeContainersByLabel drops containers having any of the labels, given as
+// key=value or as a bare key matching any value
+func excludeContainersByLabel(list []types.Container, specs []string) []types.Container {
+	var res []types.Container
+	for _, cont := range list {
+		excluded := false
+		for _, spec := range specs {
+			key, value, hasValue := strings.Cut(spec, "=")
+			if actual, found := cont.Labels[key]; found && (!hasValue || actual == value) {
+				excluded = true
+				break
+			}
 		}
-		if vector.DeletePartialMatch(labels) <= 0 {
-			log.Println("[WARN] Metric with labels hasn't been deleted:", labels)
+		if !excluded {
+			res = append(res, cont)
 		}
 	}
+	return res
+}
+
+// stopRequested reports whether a stop signal arrived, without waiting for one.
+// Used during startup, before the main loop handles the signals.
+func stopRequested(chStop <-chan os.Signal) bool {
+	select {
+	case sig := <-chStop:
+		slog.Info("Stop requested during startup", "signal", sig.String())
+		return true
+	default:
+		return false
+	}
 }
 
-func calculateCPUPercentUnix(stat *TContainerStatistic) float64 {
-	var (
-		cpuPercent = 0.0
-		// calculate the change for the cpu usage of the container in between readings
-		cpuDelta = float64(stat.CPUStats.CPUUsage.TotalUsage) - float64(stat.CPUStatsPre.CPUUsage.TotalUsage)
-		// calculate the change for the entire system between readings
-		systemDelta = float64(stat.CPUStats.SystemUsage) - float64(stat.CPUStatsPre.SystemUsage)
-	)
-
-	if systemDelta > 0.0 && cpuDelta > 0.0 {
-		cpuPercent = (cpuDelta / systemDelta) * 100.0
-		if len(stat.CPUStats.CPUUsage.PercpuUsage) > 0 {
-			cpuPercent *= float64(len(stat.CPUStats.CPUUsage.PercpuUsage))
+// stopProgram stops the monitors, the webhook notifier and the metrics server.
+// Safe to call at any point of the startup, parts not started yet are skipped.
+func stopProgram() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Wait for the monitors to finish their final callbacks
+	if statsThreads != nil {
+		if er := statsThreads.StopAll(ctx); er != nil {
+			slog.Warn("Container monitors did not finish in time", "err", er)
 		}
 	}
-	return cpuPercent
+
+	if webhook != nil {
+		_ = webhook.Stop()
+	}
+
+	if httpServer == nil {
+		return
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		fatal("Can not gracefully stop metrics server", "err", err)
+	}
+
+	return
 }
 
-func stateToValue(state string) float64 {
-	switch state {
-	case "created":
-		return 0 // 容器已创建但未启动
-	case "running":
-		return 1 // 容器正在运行
-	case "paused":
-		return 2 // 容器已暂停
-	case "restarting":
-		return 3 // 容器正在重启
-	case "removing":
-		return 4 // 容器正在被删除
-	case "exited":
-		return 5 // 容器已退出
-	case "dead":
-		return 6 // 容器已死亡，无法恢复
-	default:
-		return -1 // 未知状态
+func containerStateChanged(stat *TContainerStatistic, prevState string) {
+	slog.Info("Container state changed", "container", stat.Id[0:12], "from", prevState, "to", stat.RunningState)
+
+	if webhook == nil {
+		return
 	}
+	webhook.Notify(TWebhookEvent{
+		Id:        stat.Id,
+		Name:      normalizeContainerName(stat.Name),
+		State:     stat.RunningState,
+		PrevState: prevState,
+		Labels:    stat.Labels,
+		Host:      stat.Host,
+		Time:      time.Now(),
+	})
 }
@@ -0,0 +1,1399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/blkiodev"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricNameSpace    = "docker_stats"
+	metricSubContainer = "container"
+)
+
+var labelRegex = regexp.MustCompile("[\\W-]")
+var scrapeLabels []string
+
+// Omit the container ID label, see -no-id-label
+var noIdLabel bool
+
+// Container metric groups which can be turned off with -enable-metrics.
+// The state metrics are always enabled.
+var metricGroups = []string{"cpu", "percpu", "memory", "network", "blkio", "pids"}
+var enabledMetrics map[string]bool
+
+// Read container statistics on scrape instead of streaming them, see TPullCollector
+var pullMode bool
+
+// Unit of the CPU usage gauge, percent (cpu_pcnt) or cores (cpu_cores), see -cpu-unit
+var cpuUnit = "percent"
+
+// Omit series of containers not read within this duration, see TStaleFilterCollector
+var staleAfter time.Duration
+
+// Expose container samples with the read time of their stats frame, see TStaleFilterCollector
+var statsTimestamps bool
+
+// Add the image and image_id labels, see -image-labels
+var imageLabels bool
+
+// Add the compose_project and compose_service labels, see -compose-labels
+var composeLabels bool
+
+// Docker Compose container labels of the compose_project and compose_service labels
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// Add the docker daemon host label, set when monitoring several daemons, see -docker-hosts
+var hostLabel bool
+
+// Container label overriding the value of the name label, see -name-label. Empty for none.
+var nameLabel string
+
+// Add the node label to all metrics, see -node-label
+var nodeLabel bool
+
+// Value of the node label overriding the names of the docker daemons, see -node-name
+var nodeName string
+
+// Comma separated container labels to scrape, see loadLabelsSpec
+var labelsSpec string
+var labelsFile string
+
+// Guards the container vectors and scrapeLabels against concurrent reload
+var metricsLock sync.RWMutex
+var containerVectors []TContainerVector
+
+var registry *prometheus.Registry
+var staleFilter *TStaleFilterCollector
+var containersCount *prometheus.GaugeVec
+var configuredLabelsInfo *prometheus.GaugeVec
+
+var memUsageVec *prometheus.GaugeVec
+var memLimitVec *prometheus.GaugeVec
+var memWorkingSetVec *prometheus.GaugeVec
+var memPercentage *prometheus.GaugeVec
+
+// Total memory of the docker host, memory limit of unlimited containers
+var hostMemTotal = make(map[string]uint64)  // per host label, filled before monitoring starts
+var hostNodeNames = make(map[string]string) // daemon names per host label, filled before monitoring starts
+
+var cpuUsageTotalVec *prometheus.GaugeVec
+var cpuUsageCounter *prometheus.CounterVec
+var cpuPercentage *prometheus.GaugeVec
+var cpuPerCoreVec *prometheus.GaugeVec
+var cpuCoresVec *prometheus.GaugeVec
+var cpuThrottledPeriodsVec *prometheus.GaugeVec
+var cpuThrottledTimeVec *prometheus.GaugeVec
+
+var runningStats *prometheus.GaugeVec
+var containerStateVec *prometheus.GaugeVec
+var monitoredSinceVec *prometheus.GaugeVec
+var stateDurationVec *prometheus.GaugeVec
+var containerStartTimeVec *prometheus.GaugeVec
+var containerStartupVec *prometheus.GaugeVec
+var containerRestartCountVec *prometheus.GaugeVec
+var containerHealthVec *prometheus.GaugeVec
+var containerExitCodeVec *prometheus.GaugeVec
+var containerOomKilledVec *prometheus.GaugeVec
+var containerHealthFailingStreakVec *prometheus.GaugeVec
+
+var pidsCurrentVec *prometheus.GaugeVec
+var pidsLimitVec *prometheus.GaugeVec
+
+var blkioReadBytesVec *prometheus.GaugeVec
+var blkioWriteBytesVec *prometheus.GaugeVec
+var blkioReadBytesCounter *prometheus.CounterVec
+var blkioWriteBytesCounter *prometheus.CounterVec
+
+var blkioReadBpsLimitVec *prometheus.GaugeVec
+var blkioWriteBpsLimitVec *prometheus.GaugeVec
+
+var networkRxBytesVec *prometheus.GaugeVec
+var networkTxBytesVec *prometheus.GaugeVec
+var networkRxBytesCounter *prometheus.CounterVec
+var networkTxBytesCounter *prometheus.CounterVec
+var networkRxErrorsVec *prometheus.GaugeVec
+var networkRxDroppedVec *prometheus.GaugeVec
+var networkTxErrorsVec *prometheus.GaugeVec
+var networkTxDroppedVec *prometheus.GaugeVec
+
+// Network interfaces not exposed, see -network-exclude-interfaces
+var networkExclude *regexp.Regexp
+
+// Sum up the interfaces of a container into series without the interface label, see -network-aggregate
+var networkAggregate bool
+
+var dnsInfoEnabled bool
+var dnsInfoVec *prometheus.GaugeVec
+
+// Interval of reading container filesystem sizes, 0 when disabled
+var fsSizeInterval time.Duration
+var containerFsRwBytesVec *prometheus.GaugeVec
+var containerFsRootfsBytesVec *prometheus.GaugeVec
+
+var webhookDropped prometheus.Counter
+
+// Exporter runtime metrics
+var goroutinesGauge prometheus.Gauge
+var heapInUseGauge prometheus.Gauge
+var nextGcGauge prometheus.Gauge
+var maxStalenessGauge prometheus.Gauge
+var decodeErrors prometheus.Counter
+var inspectCalls prometheus.Counter
+var scrapeDurationVec *prometheus.GaugeVec
+var upVec *prometheus.GaugeVec
+var monitorGoroutinesGauge prometheus.Gauge
+var dockerApiErrors *prometheus.CounterVec
+var monitorsSkipped prometheus.Counter
+var streamStalls prometheus.Counter
+var monitorRestartsVec *prometheus.CounterVec
+
+// loadLabelsSpec reads the container labels to scrape from the labels file when
+// configured, otherwise from DOCKER_STATS_LABELS_SCRAPE. The file may list
+// labels separated by commas, spaces or new lines.
+func loadLabelsSpec() (string, error) {
+	spec := os.Getenv("DOCKER_STATS_LABELS_SCRAPE")
+	if labelsFile != "" {
+		data, err := os.ReadFile(labelsFile)
+		if err != nil {
+			return "", err
+		}
+		spec = strings.Join(strings.Fields(strings.ReplaceAll(string(data), ",", " ")), ",")
+	}
+
+	if err := validateLabelsSpec(spec); err != nil {
+		return "", err
+	}
+	return spec, nil
+}
+
+// validateLabelsSpec fails when scraped labels map to the same metric label
+// after normalization, or to one of the labels added by the exporter
+func validateLabelsSpec(spec string) error {
+	owners := map[string]string{
+		"id":       "the container ID label",
+		"name":     "the container name label",
+		"host":     "the docker host label",
+		"node":     "the node label",
+		"image":    "the image label",
+		"image_id": "the image ID label",
+		// compose labels
+		"compose_project": "the compose project label",
+		"compose_service": "the compose service label",
+		// extra labels of some container vectors
+		"cpu":            "the cpu_per_core label",
+		"interface":      "the network interface label",
+		"device":         "the block device label",
+		"type":           "the dns_info type label",
+		"value":          "the dns_info value label",
+		"state":          "the state label",
+		"cgroup_version": "the cgroup version label of CPU and memory metrics",
+	}
+
+	var conflicts []string
+	seen := make(map[string]bool)
+	for _, lbl := range strings.Split(spec, ",") {
+		lbl = strings.TrimSpace(lbl)
+		if lbl == "" || seen[lbl] {
+			continue // duplicates are dropped by getLabels
+		}
+		seen[lbl] = true
+
+		promLabel := labelRegex.ReplaceAllLiteralString(lbl, "_")
+		if owner, found := owners[promLabel]; found {
+			conflicts = append(conflicts, fmt.Sprintf("%q and %s both map to %q", lbl, owner, promLabel))
+			continue
+		}
+		owners[promLabel] = fmt.Sprintf("%q", lbl)
+	}
+
+	if len(conflicts) > 0 {
+		return errors.New("conflicting scrape labels: " + strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+func getLabels(normalize bool) []string {
+	labels := strings.Split(strings.TrimSpace(labelsSpec), ",")
+
+	var res []string
+	seen := make(map[string]bool)
+	for _, lbl := range labels {
+		lbl = strings.TrimSpace(lbl)
+		if lbl == "" || seen[lbl] {
+			continue
+		}
+		seen[lbl] = true
+
+		if normalize {
+			res = append(res, labelRegex.ReplaceAllLiteralString(lbl, "_"))
+		} else {
+			res = append(res, lbl)
+		}
+	}
+
+	if noIdLabel {
+		res = append([]string{"name"}, res...)
+	} else {
+		res = append([]string{"id", "name"}, res...)
+	}
+	if imageLabels {
+		res = append(res, "image", "image_id")
+	}
+	if composeLabels {
+		res = append(res, "compose_project", "compose_service")
+	}
+	if hostLabel {
+		res = append([]string{"host"}, res...)
+	}
+	if nodeLabel {
+		res = append([]string{"node"}, res...)
+	}
+
+	return res
+}
+
+// withLabels returns a copy of labels extended by extra label names
+func withLabels(labels []string, extra ...string) []string {
+	res := make([]string, 0, len(labels)+len(extra))
+	res = append(res, labels...)
+	return append(res, extra...)
+}
+
+func getContainerVector(name string, description string, labels []string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Subsystem: metricSubContainer,
+			Name:      name,
+			Help:      description,
+		},
+		labels,
+	)
+}
+
+// TContainerVector is a per-container gauge or counter vector
+type TContainerVector interface {
+	prometheus.Collector
+	Reset()
+	DeletePartialMatch(labels prometheus.Labels) int
+}
+
+// registerContainerCounter creates and registers a per-container counter vector,
+// which is re-created when scrape labels are reloaded
+func registerContainerCounter(name string, description string, labels []string) *prometheus.CounterVec {
+	vector := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Subsystem: metricSubContainer,
+			Name:      name,
+			Help:      description,
+		},
+		labels,
+	)
+	return addContainerVector(vector)
+}
+
+// registerContainerVector creates and registers a per-container vector,
+// which is re-created when scrape labels are reloaded
+func registerContainerVector(name string, description string, labels []string) *prometheus.GaugeVec {
+	return addContainerVector(getContainerVector(name, description, labels))
+}
+
+// addContainerVector adds a vector to the container vectors, which are reset and
+// cleared per container. It's registered unless the container vectors are
+// collected by TPullCollector or TStaleFilterCollector.
+func addContainerVector[T TContainerVector](vector T) T {
+	if !pullMode && staleAfter == 0 && !statsTimestamps {
+		vector = registerCollector(vector)
+	}
+	containerVectors = append(containerVectors, vector)
+	return vector
+}
+
+// registerCollector registers a collector, or returns the collector registered
+// before with the same descriptors, so metrics can be initialized again. Other
+// registration errors are logged, the collector then isn't exposed.
+func registerCollector[T prometheus.Collector](collector T) T {
+	err := registry.Register(collector)
+	if err == nil {
+		return collector
+	}
+
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	slog.Error("Can not register metric collector", "err", err)
+	return collector
+}
+
+func initMetrics() {
+	labels := getLabels(true)
+
+	containersCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Subsystem: metricSubContainer,
+			Name:      "count",
+			Help:      "Count of running containers",
+		},
+		hostLabelNames(),
+	)
+	containersCount = registerCollector(containersCount)
+
+	configuredLabelsInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Name:      "configured_labels_info",
+			Help:      "Container labels the exporter is configured to scrape",
+		},
+		[]string{"labels"},
+	)
+	configuredLabelsInfo = registerCollector(configuredLabelsInfo)
+	configuredLabelsInfo.With(prometheus.Labels{"labels": strings.Join(getLabels(false), ",")}).Set(1)
+
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Subsystem: "exporter",
+			Name:      "build_info",
+			Help:      "Version, commit and Go version the exporter was built with",
+		},
+		[]string{"version", "commit", "go_version"},
+	)
+	buildInfo = registerCollector(buildInfo)
+	buildInfo.With(prometheus.Labels{"version": version, "commit": commit, "go_version": runtime.Version()}).Set(1)
+
+	initContainerMetrics(labels)
+	// Unchecked collectors have no descriptors to detect a second registration by
+	if (staleAfter > 0 || statsTimestamps) && !pullMode && staleFilter == nil {
+		staleFilter = registerCollector(&TStaleFilterCollector{MaxAge: staleAfter, Timestamps: statsTimestamps})
+	}
+
+	webhookDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Subsystem: "webhook",
+			Name:      "dropped_total",
+			Help:      "Count of webhook notifications dropped because the queue was full",
+		},
+	)
+	webhookDropped = registerCollector(webhookDropped)
+
+	decodeErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Name:      "decode_errors_total",
+			Help:      "Count of malformed container statistic frames skipped",
+		},
+	)
+	decodeErrors = registerCollector(decodeErrors)
+
+	inspectCalls = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Name:      "inspect_calls_total",
+			Help:      "Number of container inspect calls made to the Docker API",
+		},
+	)
+	inspectCalls = registerCollector(inspectCalls)
+
+	goroutinesGauge = getExporterGauge("goroutines", "Number of goroutines of the exporter")
+	goroutinesGauge = registerCollector(goroutinesGauge)
+
+	heapInUseGauge = getExporterGauge("heap_inuse_bytes", "Bytes in in-use heap spans of the exporter")
+	heapInUseGauge = registerCollector(heapInUseGauge)
+
+	nextGcGauge = getExporterGauge("next_gc_bytes", "Target heap size of the next GC cycle of the exporter")
+	nextGcGauge = registerCollector(nextGcGauge)
+
+	maxStalenessGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Name:      "max_staleness_seconds",
+			Help:      "Max time since the last statistic read across all monitored containers",
+		},
+	)
+	maxStalenessGauge = registerCollector(maxStalenessGauge)
+
+	scrapeDurationVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Name:      "scrape_duration_seconds",
+			Help:      "Duration of the last container list refresh cycle",
+		},
+		hostLabelNames(),
+	)
+	scrapeDurationVec = registerCollector(scrapeDurationVec)
+
+	upVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Name:      "up",
+			Help:      "Whether the Docker daemon was reachable on the last connection or container list refresh (1) or not (0)",
+		},
+		hostLabelNames(),
+	)
+	upVec = registerCollector(upVec)
+
+	monitorGoroutinesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Name:      "monitor_goroutines",
+			Help:      "Number of running container monitors",
+		},
+	)
+	monitorGoroutinesGauge = registerCollector(monitorGoroutinesGauge)
+
+	monitorsSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Name:      "monitors_skipped_total",
+			Help:      "Count of container monitors not started because -max-monitored was reached",
+		},
+	)
+	monitorsSkipped = registerCollector(monitorsSkipped)
+
+	streamStalls = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Name:      "stream_stalls_total",
+			Help:      "Count of container monitors restarted because their stats stream delivered no statistic in time",
+		},
+	)
+	streamStalls = registerCollector(streamStalls)
+
+	dockerApiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Name:      "docker_api_errors_total",
+			Help:      "Count of failed Docker API calls by call",
+		},
+		[]string{"call"},
+	)
+	dockerApiErrors = registerCollector(dockerApiErrors)
+
+	monitorRestartsVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNameSpace,
+			Subsystem: metricSubContainer,
+			Name:      "monitor_restarts_total",
+			Help:      "Count of container monitors re-created shortly after the previous monitor of the container stopped",
+		},
+		append(hostLabelNames(), "name"),
+	)
+	monitorRestartsVec = registerCollector(monitorRestartsVec)
+}
+
+// countApiError counts a failed Docker API call, err may be nil
+func countApiError(call string, err error) {
+	if err != nil && dockerApiErrors != nil {
+		dockerApiErrors.With(prometheus.Labels{"call": call}).Inc()
+	}
+}
+
+// initContainerMetrics creates per-container vectors for the given label set
+func initContainerMetrics(labels []string) {
+	containerVectors = nil
+	counterTotals.Clear()
+	cgroupLabels := withLabels(labels, "cgroup_version")
+
+	if metricEnabled("memory") {
+		memUsageVec = registerContainerVector("memory_usage", "Actual value of memory usage by container", cgroupLabels)
+		memLimitVec = registerContainerVector("memory_limit", "The limit of memory container can use", cgroupLabels)
+		memPercentage = registerContainerVector("memory_pcnt", "Memory usage percentage of the container limit", cgroupLabels)
+		memWorkingSetVec = registerContainerVector("memory_working_set", "Memory usage by container excluding inactive page cache, as shown by docker stats", cgroupLabels)
+	}
+
+	if metricEnabled("cpu") {
+		// The cumulative values are also exposed as gauges until dashboards moved to the counters
+		cpuUsageTotalVec = registerContainerVector("cpu_total", "CPU Usage Total (deprecated, use cpu_usage_total)", cgroupLabels)
+		cpuUsageCounter = registerContainerCounter("cpu_usage_total", "CPU time used by the container, in nanoseconds (100ns intervals on Windows)", cgroupLabels)
+		if cpuUnit == "cores" {
+			cpuCoresVec = registerContainerVector("cpu_cores", "CPU usage in cores, 1.5 means one and a half cores busy", cgroupLabels)
+		} else {
+			cpuPercentage = registerContainerVector("cpu_pcnt", "CPU Usage percentage", cgroupLabels)
+		}
+		cpuThrottledPeriodsVec = registerContainerVector("cpu_throttled_periods", "Number of CPU quota periods the container was throttled in", cgroupLabels)
+		cpuThrottledTimeVec = registerContainerVector("cpu_throttled_time", "Total time the container was throttled by its CPU quota, in nanoseconds", cgroupLabels)
+	}
+	if metricEnabled("percpu") {
+		cpuPerCoreVec = registerContainerVector("cpu_per_core", "CPU Usage Total per core", withLabels(cgroupLabels, "cpu"))
+	}
+
+	if stateMetrics != "enum" {
+		runningStats = registerContainerVector("running_stats", stateMappingHelp(), labels)
+	}
+	if stateMetrics != "numeric" {
+		containerStateVec = registerContainerVector("state", "1 for the current state of the container, 0 for the other states", withLabels(labels, "state"))
+	}
+	monitoredSinceVec = registerContainerVector("monitored_since_seconds", "Unix time the exporter started monitoring the container", labels)
+	stateDurationVec = registerContainerVector("state_duration_seconds", "How long the container has been in its current state", labels)
+	containerStartTimeVec = registerContainerVector("start_time_seconds", "Unix time the container was last started, 0 if it has never started", labels)
+	containerStartupVec = registerContainerVector("startup_seconds", "Time from the creation of the container until it was started", labels)
+	containerRestartCountVec = registerContainerVector("restart_count", "Number of times the container has been restarted by the daemon", labels)
+	containerHealthVec = registerContainerVector("health_status", "Health check status of the container: 0=none, 1=starting, 2=healthy, 3=unhealthy", labels)
+	containerHealthFailingStreakVec = registerContainerVector("health_failing_streak", "Number of consecutive failed health checks of the container", labels)
+	containerExitCodeVec = registerContainerVector("exit_code", "Exit code of an exited or dead container, absent while it runs", labels)
+	containerOomKilledVec = registerContainerVector("oom_killed", "1 when the container was last stopped by the OOM killer, 0 otherwise", labels)
+
+	if metricEnabled("pids") {
+		pidsCurrentVec = registerContainerVector("pids_current", "Number of processes and threads running in the container", labels)
+		pidsLimitVec = registerContainerVector("pids_limit", "Max number of processes and threads allowed in the container", labels)
+	}
+
+	if metricEnabled("blkio") {
+		blkioReadBytesVec = registerContainerVector("blkio_read_bytes", "Bytes read by the container from block devices", labels)
+		blkioWriteBytesVec = registerContainerVector("blkio_write_bytes", "Bytes written by the container to block devices", labels)
+		blkioReadBytesCounter = registerContainerCounter("blkio_read_bytes_total", "Bytes read by the container from block devices", labels)
+		blkioWriteBytesCounter = registerContainerCounter("blkio_write_bytes_total", "Bytes written by the container to block devices", labels)
+		blkioReadBpsLimitVec = registerContainerVector("blkio_read_bps_limit", "Configured block device read rate limit in bytes per second", withLabels(labels, "device"))
+		blkioWriteBpsLimitVec = registerContainerVector("blkio_write_bps_limit", "Configured block device write rate limit in bytes per second", withLabels(labels, "device"))
+	}
+
+	if metricEnabled("network") {
+		networkRxBytesVec = registerContainerVector("network_rx_bytes", "Bytes received by the container network interface", networkLabelNames(labels))
+		networkTxBytesVec = registerContainerVector("network_tx_bytes", "Bytes sent by the container network interface", networkLabelNames(labels))
+		networkRxBytesCounter = registerContainerCounter("network_rx_bytes_total", "Bytes received by the container network interface", networkLabelNames(labels))
+		networkTxBytesCounter = registerContainerCounter("network_tx_bytes_total", "Bytes sent by the container network interface", networkLabelNames(labels))
+		networkRxErrorsVec = registerContainerVector("network_rx_errors", "Receive errors of the container network interface", networkLabelNames(labels))
+		networkRxDroppedVec = registerContainerVector("network_rx_dropped", "Received packets dropped by the container network interface", networkLabelNames(labels))
+		networkTxErrorsVec = registerContainerVector("network_tx_errors", "Transmit errors of the container network interface", networkLabelNames(labels))
+		networkTxDroppedVec = registerContainerVector("network_tx_dropped", "Sent packets dropped by the container network interface", networkLabelNames(labels))
+	}
+
+	if dnsInfoEnabled {
+		dnsInfoVec = registerContainerVector("dns_info", "Configured DNS servers (type=dns) and extra hosts (type=extra_host) of the container", withLabels(labels, "type", "value"))
+	}
+
+	if fsSizeInterval > 0 {
+		containerFsRwBytesVec = registerContainerVector("fs_rw_bytes", "Size of the files created or changed in the container writable layer", labels)
+		containerFsRootfsBytesVec = registerContainerVector("fs_rootfs_bytes", "Size of all files of the container, including its image", labels)
+	}
+
+	initCompatMetrics(labels)
+}
+
+// reloadScrapeLabels re-reads the scrape labels and, when they changed, re-creates
+// the container vectors with the new label set. Running monitors are kept and
+// emit with the new labels on their next read.
+func reloadScrapeLabels() error {
+	spec, err := loadLabelsSpec()
+	if err != nil {
+		return err
+	}
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if spec == labelsSpec {
+		slog.Info("Scrape labels are unchanged")
+		return nil
+	}
+	labelsSpec = spec
+
+	for _, vector := range containerVectors {
+		registry.Unregister(vector)
+	}
+
+	scrapeLabels = getLabels(false)
+	initContainerMetrics(getLabels(true))
+
+	configuredLabelsInfo.Reset()
+	configuredLabelsInfo.With(prometheus.Labels{"labels": strings.Join(scrapeLabels, ",")}).Set(1)
+
+	slog.Info("Reloaded scrape labels", "labels", strings.Join(scrapeLabels, ","))
+	return nil
+}
+
+func getExporterGauge(name string, description string) prometheus.Gauge {
+	return prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricNameSpace,
+			Subsystem: "exporter",
+			Name:      name,
+			Help:      description,
+		},
+	)
+}
+
+// updateStaleness publishes the staleness of the least recently read container
+func updateStaleness() {
+	var staleness time.Duration
+	for _, key := range statsThreads.GetKeys() {
+		th, found := statsThreads.Get(key)
+		if !found {
+			continue
+		}
+		if opt := th.GetOpt("last_read"); opt != nil {
+			if since := time.Since(opt.Value.(time.Time)); since > staleness {
+				staleness = since
+			}
+		}
+	}
+	maxStalenessGauge.Set(staleness.Seconds())
+	monitorGoroutinesGauge.Set(float64(statsThreads.Len()))
+}
+
+// updateRuntimeMetrics refreshes the hand-picked exporter runtime metrics
+func updateRuntimeMetrics() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	goroutinesGauge.Set(float64(runtime.NumGoroutine()))
+	heapInUseGauge.Set(float64(mem.HeapInuse))
+	nextGcGauge.Set(float64(mem.NextGC))
+}
+
+// statisticLabels returns the values of the scraped labels of a container statistic.
+// Must be called with metricsLock held.
+func statisticLabels(stat *TContainerStatistic) prometheus.Labels {
+	labels := make(map[string]string)
+	for _, labelName := range scrapeLabels {
+		if labelName == "id" {
+			labels["id"] = stat.Id[0:12]
+			continue
+		}
+		if labelName == "host" && hostLabel {
+			labels["host"] = stat.Host
+			continue
+		}
+		if labelName == "node" && nodeLabel {
+			labels["node"] = hostNodeName(stat.Host)
+			continue
+		}
+		if labelName == "name" {
+			labels["name"] = metricContainerName(stat.Name, stat.Labels)
+			continue
+		}
+		if labelName == "image" && imageLabels {
+			labels["image"] = ""
+			if stat.Inspect.Config != nil {
+				labels["image"] = stat.Inspect.Config.Image
+			}
+			continue
+		}
+		if labelName == "compose_project" && composeLabels {
+			labels["compose_project"] = labelGuard.Value(stat.Id, composeProjectLabel, stat.Labels[composeProjectLabel])
+			continue
+		}
+		if labelName == "compose_service" && composeLabels {
+			labels["compose_service"] = labelGuard.Value(stat.Id, composeServiceLabel, stat.Labels[composeServiceLabel])
+			continue
+		}
+		if labelName == "image_id" && imageLabels {
+			labels["image_id"] = ""
+			if stat.Inspect.ContainerJSONBase != nil {
+				labels["image_id"] = stat.Inspect.Image
+			}
+			continue
+		}
+
+		promLabel := labelRegex.ReplaceAllLiteralString(labelName, "_")
+
+		if value, ok := stat.Labels[labelName]; ok {
+			labels[promLabel] = labelGuard.Value(stat.Id, labelName, value)
+		} else {
+			labels[promLabel] = ""
+		}
+	}
+	return labels
+}
+
+func containerStatisticRead(stat *TContainerStatistic) {
+	statsCache.Put(stat)
+
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	labels := statisticLabels(stat)
+
+	readTimes.Touch(labels, stat.Read)
+
+	if runningStats != nil {
+		runningStats.With(labels).Set(stateToValue(stat.RunningState))
+	}
+	if containerStateVec != nil {
+		for _, state := range containerStates {
+			value := 0.0
+			if state == stat.RunningState {
+				value = 1
+			}
+			containerStateVec.With(extendLabels(labels, "state", state)).Set(value)
+		}
+	}
+	monitoredSinceVec.With(labels).Set(float64(stat.MonitoredSince.Unix()))
+	stateDurationVec.With(labels).Set(time.Since(stat.StateSince).Seconds())
+	containerStartTimeVec.With(labels).Set(containerStartTime(stat.Inspect))
+	if stat.StartupSeconds > 0 {
+		containerStartupVec.With(labels).Set(stat.StartupSeconds)
+	}
+	if stat.Inspect.ContainerJSONBase != nil {
+		containerRestartCountVec.With(labels).Set(float64(stat.Inspect.RestartCount))
+	}
+	if base := stat.Inspect.ContainerJSONBase; base != nil && base.State != nil {
+		oomKilled := 0.0
+		if base.State.OOMKilled {
+			oomKilled = 1
+		}
+		containerOomKilledVec.With(labels).Set(oomKilled)
+	}
+	if (stat.RunningState == "exited" || stat.RunningState == "dead") && stat.Inspect.ContainerJSONBase != nil && stat.Inspect.State != nil {
+		containerExitCodeVec.With(labels).Set(float64(stat.Inspect.State.ExitCode))
+	} else {
+		containerExitCodeVec.Delete(labels)
+	}
+	if health := containerHealth(stat.Inspect); health != nil {
+		containerHealthVec.With(labels).Set(healthToValue(health.Status))
+		containerHealthFailingStreakVec.With(labels).Set(float64(health.FailingStreak))
+	} else {
+		containerHealthVec.With(labels).Set(healthToValue(""))
+		containerHealthFailingStreakVec.Delete(labels) // no health check configured
+	}
+
+	if stat.StateOnly {
+		return
+	}
+
+	// CPU and memory usage are interpreted by cgroup version
+	cgroupLabels := extendLabels(labels, "cgroup_version", stat.CgroupVersion)
+	if metricEnabled("memory") {
+		memUsageVec.With(cgroupLabels).Set(float64(stat.MemoryStats.Usage))
+		memLimitVec.With(cgroupLabels).Set(float64(stat.MemoryStats.Limit))
+		memWorkingSetVec.With(cgroupLabels).Set(float64(memoryWorkingSet(stat)))
+		if limit, total := stat.MemoryStats.Limit, hostMemTotal[stat.Host]; limit > 0 && (total == 0 || limit < total) {
+			memPercentage.With(cgroupLabels).Set(float64(stat.MemoryStats.Usage) / float64(limit) * 100.0)
+		} else {
+			memPercentage.Delete(cgroupLabels) // no memory limit set
+		}
+	}
+	if metricEnabled("cpu") {
+		cpuUsageTotalVec.With(cgroupLabels).Set(float64(stat.CPUStats.CPUUsage.TotalUsage))
+		cpuUsageCounter.With(cgroupLabels).Add(float64(counterTotals.Delta(labels, "cpu", stat.CPUStats.CPUUsage.TotalUsage)))
+		// The first frame of a stream has no previous usage, its CPU usage would
+		// spike, so it is published from the next frame on. A paused container
+		// would read as idle, it keeps its last usage or has none, see -paused-cpu.
+		if stat.RunningState == "paused" {
+			if pausedCPU == "absent" {
+				deleteOptionalMetric(cgroupLabels, cpuPercentage, cpuCoresVec)
+			}
+		} else if hasCPUDelta(stat) {
+			if cpuCoresVec != nil {
+				cpuCoresVec.With(cgroupLabels).Set(calculateCPUCores(stat))
+			} else {
+				cpuPercentage.With(cgroupLabels).Set(calculateCPUPercent(stat))
+			}
+		}
+
+		if throttling := stat.CPUStats.ThrottlingData; throttling.Periods > 0 {
+			cpuThrottledPeriodsVec.With(cgroupLabels).Set(float64(throttling.ThrottledPeriods))
+			cpuThrottledTimeVec.With(cgroupLabels).Set(float64(throttling.ThrottledTime))
+		} else {
+			// No CPU quota set, the container is never throttled
+			cpuThrottledPeriodsVec.Delete(cgroupLabels)
+			cpuThrottledTimeVec.Delete(cgroupLabels)
+		}
+	}
+
+	// Per-core usage is usually not reported on cgroup v2
+	if metricEnabled("percpu") {
+		for core, usage := range stat.CPUStats.CPUUsage.PercpuUsage {
+			cpuPerCoreVec.With(extendLabels(cgroupLabels, "cpu", strconv.Itoa(core))).Set(float64(usage))
+		}
+	}
+
+	if metricEnabled("pids") {
+		pidsCurrentVec.With(labels).Set(float64(stat.PidsStats.Current))
+		// cgroup v2 reports no limit as the max value, v1 as 0
+		if stat.PidsStats.Limit > 0 && stat.PidsStats.Limit != math.MaxUint64 {
+			pidsLimitVec.With(labels).Set(float64(stat.PidsStats.Limit))
+		} else {
+			pidsLimitVec.Delete(labels) // unlimited
+		}
+	}
+
+	if metricEnabled("blkio") {
+		readBytes, writeBytes := sumBlkioBytes(stat, "read"), sumBlkioBytes(stat, "write")
+		blkioReadBytesVec.With(labels).Set(float64(readBytes))
+		blkioWriteBytesVec.With(labels).Set(float64(writeBytes))
+		blkioReadBytesCounter.With(labels).Add(float64(counterTotals.Delta(labels, "blkio_read", readBytes)))
+		blkioWriteBytesCounter.With(labels).Add(float64(counterTotals.Delta(labels, "blkio_write", writeBytes)))
+	}
+
+	if metricEnabled("network") {
+		for iface, network := range containerNetworks(stat) {
+			networkRxBytesVec.With(networkLabels(labels, iface)).Set(float64(network.RxBytes))
+			networkTxBytesVec.With(networkLabels(labels, iface)).Set(float64(network.TxBytes))
+			networkRxBytesCounter.With(networkLabels(labels, iface)).Add(float64(counterTotals.Delta(labels, "rx_bytes/"+iface, network.RxBytes)))
+			networkTxBytesCounter.With(networkLabels(labels, iface)).Add(float64(counterTotals.Delta(labels, "tx_bytes/"+iface, network.TxBytes)))
+			networkRxErrorsVec.With(networkLabels(labels, iface)).Set(float64(network.RxErrors))
+			networkRxDroppedVec.With(networkLabels(labels, iface)).Set(float64(network.RxDropped))
+			networkTxErrorsVec.With(networkLabels(labels, iface)).Set(float64(network.TxErrors))
+			networkTxDroppedVec.With(networkLabels(labels, iface)).Set(float64(network.TxDropped))
+		}
+	}
+
+	if base := stat.Inspect.ContainerJSONBase; base != nil && base.HostConfig != nil {
+		if metricEnabled("blkio") {
+			setDeviceLimits(blkioReadBpsLimitVec, labels, base.HostConfig.BlkioDeviceReadBps)
+			setDeviceLimits(blkioWriteBpsLimitVec, labels, base.HostConfig.BlkioDeviceWriteBps)
+		}
+
+		if dnsInfoVec != nil {
+			setInfoValues(dnsInfoVec, labels, "dns", base.HostConfig.DNS)
+			setInfoValues(dnsInfoVec, labels, "extra_host", base.HostConfig.ExtraHosts)
+		}
+	}
+
+	if containerFsRwBytesVec != nil && stat.SizeRw != nil {
+		containerFsRwBytesVec.With(labels).Set(float64(*stat.SizeRw))
+	}
+	if containerFsRootfsBytesVec != nil && stat.SizeRootFs != nil {
+		containerFsRootfsBytesVec.With(labels).Set(float64(*stat.SizeRootFs))
+	}
+
+	setCompatMetrics(stat, labels)
+}
+
+// containerStartTime returns the Unix time of State.StartedAt, or 0 when the
+// container has never been started
+func containerStartTime(inspect types.ContainerJSON) float64 {
+	if inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return 0
+	}
+	startedAt, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	if err != nil || startedAt.Unix() <= 0 {
+		return 0 // docker reports 0001-01-01T00:00:00Z for never started containers
+	}
+	return float64(startedAt.UnixNano()) / 1e9
+}
+
+// containerStartupSeconds returns the time from the creation of a running
+// container until it was started, 0 when unknown
+func containerStartupSeconds(inspect types.ContainerJSON) float64 {
+	if inspect.ContainerJSONBase == nil || inspect.State == nil || !inspect.State.Running {
+		return 0
+	}
+	created, err := time.Parse(time.RFC3339Nano, inspect.Created)
+	if err != nil {
+		return 0
+	}
+	startedAt, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	if err != nil || startedAt.Before(created) {
+		return 0
+	}
+	return startedAt.Sub(created).Seconds()
+}
+
+// containerStateSince returns the time the container entered its current state
+// as reported by the daemon, zero when unknown
+func containerStateSince(inspect types.ContainerJSON) time.Time {
+	if inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return time.Time{}
+	}
+	value := inspect.State.FinishedAt
+	if inspect.State.Running {
+		value = inspect.State.StartedAt
+	}
+	since, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil || since.Unix() <= 0 {
+		return time.Time{}
+	}
+	return since
+}
+
+func setInfoValues(vector *prometheus.GaugeVec, labels prometheus.Labels, infoType string, values []string) {
+	for _, value := range values {
+		vector.With(extendLabels(extendLabels(labels, "type", infoType), "value", value)).Set(1)
+	}
+}
+
+// networkLabelNames returns the labels of the network vectors
+func networkLabelNames(labels []string) []string {
+	if networkAggregate {
+		return labels
+	}
+	return withLabels(labels, "interface")
+}
+
+// networkLabels returns the labels of the network series of an interface
+func networkLabels(labels prometheus.Labels, iface string) prometheus.Labels {
+	if networkAggregate {
+		return labels
+	}
+	return extendLabels(labels, "interface", iface)
+}
+
+// containerNetworks returns the network statistics to expose by interface.
+// Excluded interfaces are dropped; when aggregating, the others are summed up
+// under an empty interface name.
+func containerNetworks(stat *TContainerStatistic) map[string]TNetworkStats {
+	res := make(map[string]TNetworkStats, len(stat.Networks))
+	for iface, network := range stat.Networks {
+		if networkExclude != nil && networkExclude.MatchString(iface) {
+			continue
+		}
+		if !networkAggregate {
+			res[iface] = network
+			continue
+		}
+
+		total := res[""]
+		total.RxBytes += network.RxBytes
+		total.RxErrors += network.RxErrors
+		total.RxDropped += network.RxDropped
+		total.TxBytes += network.TxBytes
+		total.TxErrors += network.TxErrors
+		total.TxDropped += network.TxDropped
+		res[""] = total
+	}
+	return res
+}
+
+// extendLabels returns a copy of labels with an extra label added
+func extendLabels(labels prometheus.Labels, name string, value string) prometheus.Labels {
+	res := make(prometheus.Labels, len(labels)+1)
+	for key, lbl := range labels {
+		res[key] = lbl
+	}
+	res[name] = value
+	return res
+}
+
+func setDeviceLimits(vector *prometheus.GaugeVec, labels prometheus.Labels, devices []*blkiodev.ThrottleDevice) {
+	for _, device := range devices {
+		if device == nil {
+			continue
+		}
+		vector.With(extendLabels(labels, "device", device.Path)).Set(float64(device.Rate))
+	}
+}
+
+// parseEnabledMetrics returns the metric groups of a comma separated list.
+// Unknown groups are logged and ignored.
+func parseEnabledMetrics(list string) map[string]bool {
+	res := make(map[string]bool)
+	for _, group := range strings.Split(list, ",") {
+		if group = strings.TrimSpace(group); group == "" {
+			continue
+		}
+		if !slices.Contains(metricGroups, group) {
+			slog.Warn("Unknown metric group, ignored", "group", group)
+			continue
+		}
+		res[group] = true
+	}
+	return res
+}
+
+// metricEnabled reports whether the metric group is enabled, all groups are when not configured
+func metricEnabled(group string) bool {
+	return enabledMetrics == nil || enabledMetrics[group]
+}
+
+// normalizeContainerName returns the name label value of a container. Docker
+// reports names with a leading slash, which is removed; invalid UTF-8 sequences
+// are replaced so the value is always a valid label value. Used for both emitted
+// and deleted series, so they always match.
+func normalizeContainerName(name string) string {
+	return strings.ToValidUTF8(strings.TrimPrefix(strings.TrimSpace(name), "/"), "_")
+}
+
+// setDaemonUp publishes the result of the last connection or container list refresh of a daemon
+func setDaemonUp(host string, err error) {
+	if upVec == nil {
+		return
+	}
+	if err != nil {
+		upVec.With(hostLabels(host)).Set(0)
+	} else {
+		upVec.With(hostLabels(host)).Set(1)
+	}
+}
+
+// hostNodeName returns the value of the node label of a docker daemon: the
+// configured -node-name or the name the daemon reports, stable across redeploys
+// of the exporter unlike its own host name in a container
+func hostNodeName(host string) string {
+	if nodeName != "" {
+		return nodeName
+	}
+	return hostNodeNames[host]
+}
+
+// hostLabelNames returns the labels identifying a docker daemon
+func hostLabelNames() []string {
+	res := []string{}
+	if nodeLabel {
+		res = append(res, "node")
+	}
+	if hostLabel {
+		res = append(res, "host")
+	}
+	return res
+}
+
+// hostLabels returns the label values identifying a docker daemon
+func hostLabels(host string) prometheus.Labels {
+	labels := prometheus.Labels{}
+	if nodeLabel {
+		labels["node"] = hostNodeName(host)
+	}
+	if hostLabel {
+		labels["host"] = host
+	}
+	return labels
+}
+
+// metricContainerName returns the value of the name label of a container: the
+// value of its -name-label container label when set, its name otherwise
+func metricContainerName(name string, dockerLabels map[string]string) string {
+	if nameLabel != "" {
+		if value := strings.TrimSpace(dockerLabels[nameLabel]); value != "" {
+			return strings.ToValidUTF8(value, "_")
+		}
+	}
+	return normalizeContainerName(name)
+}
+
+// containerLabels returns the labels identifying series of a container
+func containerLabels(host string, id string, name string, dockerLabels map[string]string) prometheus.Labels {
+	labels := hostLabels(host)
+	labels["name"] = metricContainerName(name, dockerLabels)
+	if !noIdLabel {
+		labels["id"] = id[0:12]
+	}
+	return labels
+}
+
+// deleteContainerMetrics clears all series of a container
+func deleteContainerMetrics(labels prometheus.Labels) {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	readTimes.Del(labels)
+
+	deleteLabeledMetric(labels,
+		runningStats,
+		containerStateVec,
+		monitoredSinceVec,
+		stateDurationVec,
+		containerStartTimeVec,
+	)
+	// Resource usage is not reported for stopped containers
+	deleteOptionalMetric(labels,
+		memUsageVec,
+		memLimitVec,
+		memWorkingSetVec,
+		memPercentage,
+		cpuUsageTotalVec,
+		cpuPercentage,
+		cpuCoresVec,
+		cpuPerCoreVec,
+		cpuThrottledPeriodsVec,
+		cpuThrottledTimeVec,
+		pidsCurrentVec,
+		blkioReadBytesVec,
+		blkioWriteBytesVec,
+		pidsLimitVec,
+		networkRxBytesVec,
+		networkTxBytesVec,
+		networkRxErrorsVec,
+		networkRxDroppedVec,
+		networkTxErrorsVec,
+		networkTxDroppedVec,
+		blkioReadBpsLimitVec,
+		blkioWriteBpsLimitVec,
+		dnsInfoVec,
+		containerRestartCountVec,
+		containerHealthVec,
+		containerHealthFailingStreakVec,
+		containerExitCodeVec,
+		containerOomKilledVec,
+		containerFsRwBytesVec,
+		containerFsRootfsBytesVec,
+		containerStartupVec,
+	)
+	deleteOptionalCounter(labels,
+		cpuUsageCounter,
+		blkioReadBytesCounter,
+		blkioWriteBytesCounter,
+		networkRxBytesCounter,
+		networkTxBytesCounter,
+	)
+	counterTotals.Del(labels)
+	deleteCompatMetrics(labels)
+}
+
+func deleteLabeledMetric(labels prometheus.Labels, vectors ...*prometheus.GaugeVec) {
+
+	for _, vector := range vectors {
+		if vector == nil {
+			continue
+		}
+		if vector.DeletePartialMatch(labels) <= 0 {
+			slog.Warn("Metric with labels hasn't been deleted", "labels", labels)
+		}
+	}
+}
+
+// deleteOptionalMetric clears metrics which may legitimately have no series for a container
+func deleteOptionalMetric(labels prometheus.Labels, vectors ...*prometheus.GaugeVec) {
+	for _, vector := range vectors {
+		if vector != nil {
+			vector.DeletePartialMatch(labels)
+		}
+	}
+}
+
+// deleteOptionalCounter clears counters which may legitimately have no series for a container
+func deleteOptionalCounter(labels prometheus.Labels, vectors ...*prometheus.CounterVec) {
+	for _, vector := range vectors {
+		if vector != nil {
+			vector.DeletePartialMatch(labels)
+		}
+	}
+}
+
+// memoryWorkingSet returns memory usage without the inactive page cache like
+// docker stats: "total_inactive_file" on cgroup v1, "inactive_file" on cgroup v2,
+// raw usage when neither is reported
+func memoryWorkingSet(stat *TContainerStatistic) uint64 {
+	usage := stat.MemoryStats.Usage
+
+	inactive, found := stat.MemoryStats.Stats["total_inactive_file"]
+	if !found {
+		inactive, found = stat.MemoryStats.Stats["inactive_file"]
+	}
+	if !found || inactive > usage {
+		return usage
+	}
+	return usage - inactive
+}
+
+// sumBlkioBytes sums serviced bytes of all block devices for the operation (case-insensitive)
+func sumBlkioBytes(stat *TContainerStatistic, op string) uint64 {
+	var res uint64
+	for _, entry := range stat.BlkioStats.IoServiceBytesRecursive {
+		if strings.EqualFold(entry.Op, op) {
+			res += entry.Value
+		}
+	}
+	return res
+}
+
+// detectCgroupVersion guesses the cgroup version from the shape of a statistic:
+// cgroup v1 reports the page cache and per-core usage, v2 reports inactive_file
+func detectCgroupVersion(stat *TContainerStatistic) string {
+	if _, found := stat.MemoryStats.Stats["cache"]; found || len(stat.CPUStats.CPUUsage.PercpuUsage) > 0 {
+		return "1"
+	}
+	if _, found := stat.MemoryStats.Stats["inactive_file"]; found {
+		return "2"
+	}
+	return ""
+}
+
+// hasCPUDelta reports whether the statistic carries the previous CPU usage,
+// which the first frame of a stats stream lacks
+func hasCPUDelta(stat *TContainerStatistic) bool {
+	if stat.PreRead.IsZero() {
+		return false
+	}
+	return stat.CPUStatsPre.CPUUsage.TotalUsage > 0 || stat.CPUStatsPre.SystemUsage > 0
+}
+
+// calculateCPUPercent picks the formula matching the platform of the container
+func calculateCPUPercent(stat *TContainerStatistic) float64 {
+	if stat.Platform == "windows" {
+		return calculateCPUPercentWindows(stat)
+	}
+	return calculateCPUPercentUnix(stat)
+}
+
+func calculateCPUPercentUnix(stat *TContainerStatistic) float64 {
+	var (
+		cpuPercent = 0.0
+		// calculate the change for the cpu usage of the container in between readings
+		cpuDelta = float64(stat.CPUStats.CPUUsage.TotalUsage) - float64(stat.CPUStatsPre.CPUUsage.TotalUsage)
+		// calculate the change for the entire system between readings
+		systemDelta = float64(stat.CPUStats.SystemUsage) - float64(stat.CPUStatsPre.SystemUsage)
+	)
+
+	if systemDelta > 0.0 && cpuDelta > 0.0 {
+		cpuPercent = (cpuDelta / systemDelta) * float64(onlineCPUs(stat)) * 100.0
+	}
+	return cpuPercent
+}
+
+// calculateCPUPercentWindows computes the CPU percentage the way `docker stats`
+// does on Windows, where TotalUsage is counted in 100ns intervals and there is
+// no system usage
+func calculateCPUPercentWindows(stat *TContainerStatistic) float64 {
+	procs := uint64(stat.NumProcs)
+	if procs == 0 {
+		procs = uint64(onlineCPUs(stat))
+	}
+
+	// Number of 100ns intervals available to the container between the readings
+	possIntervals := uint64(stat.Read.Sub(stat.PreRead).Nanoseconds()) / 100 * procs
+	if possIntervals == 0 || stat.CPUStats.CPUUsage.TotalUsage < stat.CPUStatsPre.CPUUsage.TotalUsage {
+		return 0.0
+	}
+	intervalsUsed := stat.CPUStats.CPUUsage.TotalUsage - stat.CPUStatsPre.CPUUsage.TotalUsage
+	return float64(intervalsUsed) / float64(possIntervals) * 100.0
+}
+
+// calculateCPUCores returns the number of cores the container kept busy between
+// the two readings, at most the number of online CPUs
+func calculateCPUCores(stat *TContainerStatistic) float64 {
+	if stat.PreRead.IsZero() || !stat.Read.After(stat.PreRead) {
+		return 0.0 // first reading, no previous usage to compare with
+	}
+	if stat.CPUStats.CPUUsage.TotalUsage < stat.CPUStatsPre.CPUUsage.TotalUsage {
+		return 0.0
+	}
+
+	used := float64(stat.CPUStats.CPUUsage.TotalUsage - stat.CPUStatsPre.CPUUsage.TotalUsage)
+	if stat.Platform == "windows" {
+		used *= 100 // usage counted in 100ns intervals
+	}
+	cores := used / float64(stat.Read.Sub(stat.PreRead).Nanoseconds())
+	return min(cores, float64(onlineCPUs(stat)))
+}
+
+// onlineCPUs returns the number of CPUs available to the container. PercpuUsage
+// is empty on cgroup v2, so prefer OnlineCPUs like `docker stats` does.
+func onlineCPUs(stat *TContainerStatistic) int {
+	if stat.CPUStats.OnlineCPUs > 0 {
+		return int(stat.CPUStats.OnlineCPUs)
+	}
+	if cores := len(stat.CPUStats.CPUUsage.PercpuUsage); cores > 0 {
+		return cores
+	}
+	return runtime.NumCPU()
+}
+
+// containerHealth returns the health check state of the container, nil without health check
+func containerHealth(inspect types.ContainerJSON) *types.Health {
+	if inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return nil
+	}
+	return inspect.State.Health
+}
+
+func healthToValue(status string) float64 {
+	switch status {
+	case "starting":
+		return 1
+	case "healthy":
+		return 2
+	case "unhealthy":
+		return 3
+	default:
+		return 0 // no health check
+	}
+}
+
+// Container states in the order of the detailed mapping
+var containerStates = []string{"created", "running", "paused", "restarting", "removing", "exited", "dead"}
+
+// Named mappings of container states to running_stats values, see -state-mapping
+var stateMappingPresets = map[string]map[string]float64{
+	"detailed": {
+		"created":    0, // 容器已创建但未启动
+		"running":    1, // 容器正在运行
+		"paused":     2, // 容器已暂停
+		"restarting": 3, // 容器正在重启
+		"removing":   4, // 容器正在被删除
+		"exited":     5, // 容器已退出
+		"dead":       6, // 容器已死亡，无法恢复
+	},
+	"binary": {
+		"created":    0,
+		"running":    1,
+		"paused":     0,
+		"restarting": 0,
+		"removing":   0,
+		"exited":     0,
+		"dead":       0,
+	},
+}
+
+// Container state metrics: numeric (running_stats), enum (state, one series per
+// state) or both, see -state-metrics
+var stateMetrics = "numeric"
+
+// CPU usage of paused containers: hold (keep the last usage) or absent, see -paused-cpu
+var pausedCPU = "hold"
+
+// Mapping of container states to running_stats values
+var stateMapping = stateMappingPresets["detailed"]
+
+// parseStateMapping returns the state mapping of a preset name or of a comma
+// separated list of state=value pairs. States not listed map to -1.
+func parseStateMapping(spec string) (map[string]float64, error) {
+	if preset, found := stateMappingPresets[spec]; found {
+		return preset, nil
+	}
+
+	res := make(map[string]float64)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		state, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("invalid state mapping %q, expected state=value", pair))
+		}
+		state = strings.TrimSpace(state)
+		if !slices.Contains(containerStates, state) {
+			return nil, errors.New(fmt.Sprintf("unknown container state %q", state))
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid value of state %s: %s", state, err))
+		}
+		res[state] = number
+	}
+	if len(res) == 0 {
+		return nil, errors.New("state mapping is empty")
+	}
+	return res, nil
+}
+
+// stateMappingHelp describes the state mapping in the help of running_stats
+func stateMappingHelp() string {
+	var pairs []string
+	for _, state := range containerStates {
+		if value, found := stateMapping[state]; found {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", strconv.FormatFloat(value, 'g', -1, 64), state))
+		}
+	}
+	return "Numeric representation of container state: " + strings.Join(append(pairs, "-1=unknown"), ", ")
+}
+
+func stateToValue(state string) float64 {
+	if value, found := stateMapping[state]; found {
+		return value
+	}
+	return -1 // 未知状态
+}
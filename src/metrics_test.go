@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"math"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// cpuStatistic returns a statistic with the given cumulative CPU usages of the
+// previous and the current reading
+func cpuStatistic(preTotal, total, preSystem, system uint64, onlineCPUs uint32, percpu []uint64) *TContainerStatistic {
+	stat := new(TContainerStatistic)
+	stat.CPUStatsPre.CPUUsage.TotalUsage = preTotal
+	stat.CPUStatsPre.SystemUsage = preSystem
+	stat.CPUStats.CPUUsage.TotalUsage = total
+	stat.CPUStats.CPUUsage.PercpuUsage = percpu
+	stat.CPUStats.SystemUsage = system
+	stat.CPUStats.OnlineCPUs = onlineCPUs
+	return stat
+}
+
+func TestCalculateCPUPercentUnix(t *testing.T) {
+	tests := []struct {
+		name     string
+		stat     *TContainerStatistic
+		expected float64
+	}{
+		{
+			// cgroup v1 reports the per-core usage and no online CPUs on old daemons
+			name:     "cgroup v1",
+			stat:     cpuStatistic(1000000000, 1400000000, 100000000000, 104000000000, 0, []uint64{350000000, 350000000, 350000000, 350000000}),
+			expected: 40,
+		},
+		{
+			name:     "cgroup v1 with online cpus",
+			stat:     cpuStatistic(1000000000, 1400000000, 100000000000, 104000000000, 2, []uint64{700000000, 700000000, 0, 0}),
+			expected: 20,
+		},
+		{
+			// cgroup v2 has no per-core usage
+			name:     "cgroup v2",
+			stat:     cpuStatistic(2000000000, 2500000000, 200000000000, 210000000000, 2, nil),
+			expected: 10,
+		},
+		{
+			name:     "no system delta",
+			stat:     cpuStatistic(2000000000, 2500000000, 200000000000, 200000000000, 2, nil),
+			expected: 0,
+		},
+		{
+			name:     "usage reset",
+			stat:     cpuStatistic(2500000000, 2000000000, 200000000000, 210000000000, 2, nil),
+			expected: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Same formula as `docker stats`: usage delta / system delta * online CPUs * 100
+			if actual := calculateCPUPercentUnix(test.stat); math.Abs(actual-test.expected) > 1e-9 {
+				t.Errorf("calculateCPUPercentUnix() = %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+// setGlobal sets a package variable for the duration of the test
+func setGlobal[T any](t *testing.T, variable *T, value T) {
+	previous := *variable
+	*variable = value
+	t.Cleanup(func() { *variable = previous })
+}
+
+// initTestMetrics creates the metrics on a new registry with the default label set
+func initTestMetrics(t *testing.T) {
+	setGlobal(t, &registry, prometheus.NewRegistry())
+	setGlobal(t, &labelsSpec, "")
+	setGlobal(t, &scrapeLabels, getLabels(false))
+	initMetrics()
+}
+
+// gatherFamilies returns the gathered metric families by name
+func gatherFamilies(t *testing.T) map[string]*dto.MetricFamily {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("can not gather metrics: %v", err)
+	}
+	res := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		res[family.GetName()] = family
+	}
+	return res
+}
+
+func TestUnlimitedPidsHasNoLimit(t *testing.T) {
+	initTestMetrics(t)
+
+	// cgroup v2 reports the unlimited pids limit as the max uint64
+	payload, err := os.ReadFile("testdata/stats_cgroup_v2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := new(TContainerStatistic)
+	if err := json.Unmarshal(payload, stat); err != nil {
+		t.Fatal(err)
+	}
+	stat.RunningState = "running"
+	containerStatisticRead(stat)
+
+	families := gatherFamilies(t)
+	if family, found := families["docker_stats_container_pids_limit"]; found && len(family.GetMetric()) > 0 {
+		t.Errorf("pids_limit of an unlimited container = %v, expected no series", family.GetMetric())
+	}
+	if current := families["docker_stats_container_pids_current"]; current == nil || current.GetMetric()[0].GetGauge().GetValue() != 12 {
+		t.Errorf("pids_current = %v, expected 12", current.GetMetric())
+	}
+}
+
+func TestMemoryWorkingSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		usage    uint64
+		stats    map[string]uint64
+		expected uint64
+	}{
+		// Active or dirty cache is part of the working set, like in docker stats
+		{name: "cgroup v1", usage: 500, stats: map[string]uint64{"cache": 300, "total_inactive_file": 100}, expected: 400},
+		{name: "cgroup v2", usage: 500, stats: map[string]uint64{"file": 300, "inactive_file": 200}, expected: 300},
+		{name: "no inactive file", usage: 500, stats: map[string]uint64{"cache": 300}, expected: 500},
+		{name: "inactive file over usage", usage: 500, stats: map[string]uint64{"inactive_file": 600}, expected: 500},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stat := new(TContainerStatistic)
+			stat.MemoryStats.Usage = test.usage
+			stat.MemoryStats.Stats = test.stats
+			if actual := memoryWorkingSet(stat); actual != test.expected {
+				t.Errorf("memoryWorkingSet() = %d, expected %d", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestContainerLabelsMatchStatisticLabels(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	dockerLabels := map[string]string{"env": "prod", "team.name": "core", "monitoring.rename": "web"}
+
+	tests := []struct {
+		name      string
+		hostLabel bool
+		noIdLabel bool
+		nodeLabel bool
+		nameLabel string
+	}{
+		{name: "defaults"},
+		{name: "without id label", noIdLabel: true},
+		{name: "with host label", hostLabel: true},
+		{name: "with node label", nodeLabel: true},
+		{name: "with name label", nameLabel: "monitoring.rename"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setGlobal(t, &labelsSpec, "env,team.name")
+			setGlobal(t, &hostLabel, test.hostLabel)
+			setGlobal(t, &noIdLabel, test.noIdLabel)
+			setGlobal(t, &nodeLabel, test.nodeLabel)
+			setGlobal(t, &nameLabel, test.nameLabel)
+			setGlobal(t, &hostNodeNames, map[string]string{"tcp://10.0.0.5:2376": "node-5"})
+			setGlobal(t, &registry, prometheus.NewRegistry())
+			setGlobal(t, &scrapeLabels, getLabels(false))
+			initMetrics()
+
+			stat := &TContainerStatistic{Id: id, Name: "/web-1", Host: "tcp://10.0.0.5:2376", RunningState: "running", Labels: dockerLabels}
+			containerStatisticRead(stat)
+			if family := gatherFamilies(t)["docker_stats_container_running_stats"]; family == nil || len(family.GetMetric()) != 1 {
+				t.Fatal("running_stats of the container was not emitted")
+			}
+
+			// The deleted labels are matched partially, they must select the emitted series
+			deleteContainerMetrics(containerLabels(stat.Host, stat.Id, stat.Name, stat.Labels))
+			for name, family := range gatherFamilies(t) {
+				for _, metric := range family.GetMetric() {
+					for _, label := range metric.GetLabel() {
+						if label.GetName() == "name" {
+							t.Errorf("%s of the deleted container is still emitted", name)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateCPUPercentWindows(t *testing.T) {
+	read := time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		stat     *TContainerStatistic
+		expected float64
+	}{
+		{
+			// 2 processors for 1s are 2e7 intervals of 100ns, 5e6 of them used
+			name:     "num procs",
+			stat:     windowsStatistic(read, time.Second, 10000000, 15000000, 2, 0),
+			expected: 25,
+		},
+		{
+			name:     "online cpus without num procs",
+			stat:     windowsStatistic(read, time.Second, 10000000, 15000000, 0, 4),
+			expected: 12.5,
+		},
+		{
+			name:     "first reading",
+			stat:     windowsStatistic(read, 0, 0, 15000000, 2, 0),
+			expected: 0,
+		},
+		{
+			name:     "usage reset",
+			stat:     windowsStatistic(read, time.Second, 15000000, 10000000, 2, 0),
+			expected: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := calculateCPUPercentWindows(test.stat); math.Abs(actual-test.expected) > 1e-9 {
+				t.Errorf("calculateCPUPercentWindows() = %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestCalculateCPUPercentPlatform(t *testing.T) {
+	// Valid for both formulas: 25% on Windows, 5% on Linux with its system usage
+	stat := windowsStatistic(time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC), time.Second, 10000000, 15000000, 2, 2)
+	stat.CPUStatsPre.SystemUsage = 100000000
+	stat.CPUStats.SystemUsage = 300000000
+
+	stat.Platform = "windows"
+	if actual := calculateCPUPercent(stat); math.Abs(actual-25) > 1e-9 {
+		t.Errorf("calculateCPUPercent() of windows = %v, expected 25", actual)
+	}
+	stat.Platform = "linux"
+	if actual := calculateCPUPercent(stat); math.Abs(actual-5) > 1e-9 {
+		t.Errorf("calculateCPUPercent() of linux = %v, expected 5", actual)
+	}
+	stat.Platform = ""
+	if actual := calculateCPUPercent(stat); math.Abs(actual-5) > 1e-9 {
+		t.Errorf("calculateCPUPercent() of unknown platform = %v, expected the linux formula 5", actual)
+	}
+}
+
+// windowsStatistic returns a statistic of a Windows container read at read,
+// elapsed after the previous reading, with the usage in 100ns intervals
+func windowsStatistic(read time.Time, elapsed time.Duration, preTotal, total uint64, numProcs uint, onlineCPUs uint32) *TContainerStatistic {
+	stat := cpuStatistic(preTotal, total, 0, 0, onlineCPUs, nil)
+	stat.Platform = "windows"
+	stat.Read = read
+	stat.PreRead = read.Add(-elapsed)
+	stat.NumProcs = numProcs
+	return stat
+}
+
+func TestValidateLabelsSpec(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{spec: "", valid: true},
+		{spec: "env,team", valid: true},
+		{spec: "env,env", valid: true}, // duplicates are dropped
+		{spec: "my-label,my.label", valid: false},
+		{spec: "com.example/tier,com.example.tier", valid: false},
+		{spec: "name", valid: false},
+		{spec: "interface", valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			err := validateLabelsSpec(test.spec)
+			if test.valid && err != nil {
+				t.Errorf("validateLabelsSpec(%q) = %v, expected no error", test.spec, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("validateLabelsSpec(%q) returned no error, expected a collision", test.spec)
+			}
+		})
+	}
+}
+
+func TestGetLabelsDeduplicates(t *testing.T) {
+	setGlobal(t, &labelsSpec, "env, env,team")
+	setGlobal(t, &noIdLabel, false)
+	setGlobal(t, &hostLabel, false)
+	setGlobal(t, &nodeLabel, false)
+	setGlobal(t, &imageLabels, false)
+	setGlobal(t, &composeLabels, false)
+
+	labels := getLabels(true)
+	expected := []string{"id", "name", "env", "team"}
+	if !slices.Equal(labels, expected) {
+		t.Errorf("getLabels() = %v, expected %v", labels, expected)
+	}
+}
+
+func TestFirstFrameHasNoCPUPercent(t *testing.T) {
+	initTestMetrics(t)
+
+	// The first frame of a stats stream has no previous reading
+	stat := cpuStatistic(0, 2000000000, 0, 20000000000, 2, nil)
+	stat.Id = testContainerId
+	stat.Name = "/first-frame"
+	stat.Read = time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC)
+	stat.RunningState = "running"
+	containerStatisticRead(stat)
+
+	if family, found := gatherFamilies(t)["docker_stats_container_cpu_pcnt"]; found && len(family.GetMetric()) > 0 {
+		t.Errorf("cpu_pcnt of the first frame = %v, expected no series", family.GetMetric())
+	}
+}
+
+func TestInitMetricsTwice(t *testing.T) {
+	initTestMetrics(t)
+	memUsage := memUsageVec
+
+	// A reload initializes the metrics again on the same registry
+	initMetrics()
+
+	if memUsageVec != memUsage {
+		t.Error("initMetrics() replaced the registered memory usage vector, expected it to be reused")
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Errorf("can not gather metrics after initializing twice: %v", err)
+	}
+}
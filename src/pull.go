@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/docker/docker/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max number of containers read in parallel during a scrape in pull mode
+const PullConcurrency = 16
+
+// TPullCollector reads container statistics when metrics are scraped, see
+// -pull-mode. No goroutine and no stats stream is kept per container between
+// scrapes, which saves the exporter and the daemon a lot of work on hosts with
+// many containers. The price is the scrape latency: the daemon samples CPU
+// usage twice for a one-shot read, so a scrape takes one to two seconds plus
+// the time to inspect every container.
+type TPullCollector struct {
+	sync.Mutex // one scrape at a time, they share the container vectors
+
+	Endpoints []*TDockerEndpoint
+	Timeout   time.Duration // max duration of reading all containers of a scrape
+
+	firstSeen map[string]time.Time // time a container showed up in a scrape, by host and ID
+}
+
+// Describe sends no descriptors: the collector is unchecked, since its vectors
+// are re-created with other labels on reload
+func (c *TPullCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *TPullCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	// Series of removed containers are dropped by starting every scrape afresh
+	resetContainerMetrics()
+	statsCache.Clear()
+
+	// Daemons are read in parallel, so a slow one doesn't delay the others
+	var wg sync.WaitGroup
+	var seenLock sync.Mutex
+	seen := make(map[string]time.Time)
+	for _, ep := range c.Endpoints {
+		wg.Add(1)
+		go func(ep *TDockerEndpoint) {
+			defer wg.Done()
+
+			started := time.Now()
+			pulled := c.pull(ctx, ep)
+			scrapeDurationVec.With(hostLabels(ep.Label)).Set(time.Since(started).Seconds())
+
+			seenLock.Lock()
+			for key, since := range pulled {
+				seen[key] = since
+			}
+			seenLock.Unlock()
+		}(ep)
+	}
+	wg.Wait()
+	// Label values of containers gone since the last scrape no longer count
+	for key := range c.firstSeen {
+		if _, found := seen[key]; !found {
+			labelGuard.Forget(key[strings.LastIndex(key, "#")+1:])
+		}
+	}
+	c.firstSeen = seen
+
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+	for _, vector := range containerVectors {
+		vector.Collect(ch)
+	}
+}
+
+// pull reads the statistics of all containers of the endpoint and returns the
+// time each of them was first seen
+func (c *TPullCollector) pull(ctx context.Context, ep *TDockerEndpoint) map[string]time.Time {
+	seen := make(map[string]time.Time)
+
+	containerList, err := ep.listContainers(ctx)
+	setDaemonUp(ep.Label, err)
+	if err != nil {
+		slog.Error("Error getting container list", "host", ep.Cli.DaemonHost(), "err", err)
+		return seen
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, PullConcurrency)
+
+	for _, cont := range containerList {
+		key := ep.key(cont.ID)
+		since, found := c.firstSeen[key]
+		if !found {
+			since = time.Now()
+		}
+		seen[key] = since
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(id string, since time.Time) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			stat, er := ep.pullStatistic(ctx, id)
+			if er != nil {
+				if client.IsErrNotFound(er) {
+					return // removed since the list
+				}
+				slog.Error("Error reading container statistic", "container", id[0:12], "err", er)
+				return
+			}
+			stat.MonitoredSince = since
+			if stat.StateSince.IsZero() {
+				stat.StateSince = since
+			}
+
+			containerStatisticRead(stat)
+		}(cont.ID, since)
+	}
+	wg.Wait()
+	return seen
+}
+
+// pullStatistic reads a single statistic of a container, state only when it is not running
+func (ep *TDockerEndpoint) pullStatistic(ctx context.Context, containerId string) (*TContainerStatistic, error) {
+	if inspectCalls != nil {
+		inspectCalls.Inc()
+	}
+	containerInspect, err := ep.Cli.ContainerInspect(ctx, containerId)
+	if err != nil {
+		if ctx.Err() == nil && !client.IsErrNotFound(err) {
+			countApiError("inspect", err)
+		}
+		return nil, err
+	}
+
+	stat := new(TContainerStatistic)
+	if containerInspect.State.Running {
+		stream, err := ep.Cli.ContainerStats(ctx, containerId, false)
+		if err != nil {
+			if ctx.Err() == nil && !client.IsErrNotFound(err) {
+				countApiError("stats", err)
+			}
+			return nil, err
+		}
+		defer stream.Body.Close()
+
+		if err := json.NewDecoder(stream.Body).Decode(stat); err != nil {
+			return nil, err
+		}
+	} else {
+		stat.StateOnly = true
+	}
+
+	stat.Id = containerId
+	stat.Name = containerInspect.Name
+	stat.Host = ep.Label
+	stat.Platform = ep.Platform
+	stat.CgroupVersion = ep.CgroupVersion
+	if stat.CgroupVersion == "" && stat.Platform != "windows" && !stat.StateOnly {
+		stat.CgroupVersion = detectCgroupVersion(stat)
+	}
+	stat.Labels = containerInspect.Config.Labels
+	stat.Inspect = containerInspect
+	stat.RunningState = containerInspect.State.Status
+	stat.StateSince = containerStateSince(containerInspect)
+	stat.StartupSeconds = containerStartupSeconds(containerInspect)
+	return stat, nil
+}
+
+// resetContainerMetrics drops the series of all containers
+func resetContainerMetrics() {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	for _, vector := range containerVectors {
+		vector.Reset()
+	}
+	counterTotals.Clear()
+	compatTotals.Clear()
+}
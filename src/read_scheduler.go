@@ -0,0 +1,106 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// TReadScheduler bounds the number of statistic reads running at once across
+// the container monitors, see -max-parallel-reads. When all slots are busy the
+// waiting monitor with the oldest last read gets the next free slot, so every
+// container is still read within a bounded time when the reads can't keep up
+// with the tick interval.
+type TReadScheduler struct {
+	sync.Mutex
+	Slots int // max reads at once, 0 for unlimited
+
+	busy    int
+	waiters TReadWaiters
+}
+
+// TReadWaiter is a monitor waiting for a read slot
+type TReadWaiter struct {
+	lastRead time.Time
+	ready    chan struct{} // closed when the slot is handed over
+	index    int           // position in the heap, -1 once removed
+}
+
+// TReadWaiters is a heap of waiting monitors, the most stale one first
+type TReadWaiters []*TReadWaiter
+
+func (w TReadWaiters) Len() int           { return len(w) }
+func (w TReadWaiters) Less(i, j int) bool { return w[i].lastRead.Before(w[j].lastRead) }
+func (w TReadWaiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *TReadWaiters) Push(x any) {
+	waiter := x.(*TReadWaiter)
+	waiter.index = len(*w)
+	*w = append(*w, waiter)
+}
+
+func (w *TReadWaiters) Pop() any {
+	old := *w
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	waiter.index = -1
+	*w = old[:len(old)-1]
+	return waiter
+}
+
+// Acquire blocks until the monitor last read at lastRead may read, it must call
+// Release once done. Returns the error of ctx when it is done before.
+func (s *TReadScheduler) Acquire(ctx context.Context, lastRead time.Time) error {
+	if s.Slots <= 0 {
+		return nil
+	}
+
+	s.Lock()
+	if s.busy < s.Slots && len(s.waiters) == 0 {
+		s.busy++
+		s.Unlock()
+		return nil
+	}
+	waiter := &TReadWaiter{lastRead: lastRead, ready: make(chan struct{})}
+	heap.Push(&s.waiters, waiter)
+	s.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		s.Lock()
+		if waiter.index >= 0 {
+			heap.Remove(&s.waiters, waiter.index)
+			s.Unlock()
+			return ctx.Err()
+		}
+		s.Unlock()
+		// The slot was handed over meanwhile, pass it on
+		s.Release()
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot of a read, handing it over to the most stale waiting monitor
+func (s *TReadScheduler) Release() {
+	if s.Slots <= 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if len(s.waiters) > 0 {
+		waiter := heap.Pop(&s.waiters).(*TReadWaiter)
+		close(waiter.ready)
+		return
+	}
+	s.busy--
+}
+
+var readScheduler = new(TReadScheduler)
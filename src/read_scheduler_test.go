@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitWaiters waits until n monitors wait for a slot
+func waitWaiters(t *testing.T, s *TReadScheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.Lock()
+		waiting := len(s.waiters)
+		s.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d monitors do not wait for a slot", n)
+}
+
+func TestReadSchedulerMostStaleFirst(t *testing.T) {
+	s := &TReadScheduler{Slots: 1}
+	if err := s.Acquire(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	granted := make(chan int, 3)
+	for i, second := range []int{3, 1, 2} {
+		go func(second int) {
+			if err := s.Acquire(context.Background(), base.Add(time.Duration(second)*time.Second)); err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- second
+		}(second)
+		waitWaiters(t, s, i+1)
+	}
+	// Abandoned by its monitor, it doesn't hold up the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() { cancelled <- s.Acquire(ctx, base) }()
+	waitWaiters(t, s, 4)
+	cancel()
+	if err := <-cancelled; err == nil {
+		t.Error("Acquire() of a stopped monitor returned no error")
+	}
+
+	for _, expected := range []int{1, 2, 3} {
+		s.Release()
+		select {
+		case second := <-granted:
+			if second != expected {
+				t.Errorf("slot went to the monitor read at second %d, expected %d", second, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no monitor got the released slot")
+		}
+	}
+	s.Release()
+	if s.busy != 0 {
+		t.Errorf("%d slots busy after all reads, expected none", s.busy)
+	}
+}
+
+func TestReadSchedulerUnlimited(t *testing.T) {
+	s := new(TReadScheduler)
+	for i := 0; i < 100; i++ {
+		if err := s.Acquire(context.Background(), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
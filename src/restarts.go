@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A monitor created within this time after the previous monitor of the same
+// container stopped counts as a monitor restart
+const MonitorRestartWindow = 5 * time.Minute
+
+// TRecentStops holds the time the monitor of a container stopped, keyed by host and name
+type TRecentStops struct {
+	sync.Mutex
+	items map[string]time.Time
+}
+
+func (r *TRecentStops) Stopped(host string, name string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.items == nil {
+		r.items = make(map[string]time.Time)
+	}
+	// Forget containers which were not monitored again in time
+	for key, stopped := range r.items {
+		if time.Since(stopped) > MonitorRestartWindow {
+			delete(r.items, key)
+		}
+	}
+	r.items[host+"#"+normalizeContainerName(name)] = time.Now()
+}
+
+// Restarted reports whether a monitor of the container stopped recently
+func (r *TRecentStops) Restarted(host string, name string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	key := host + "#" + normalizeContainerName(name)
+	stopped, found := r.items[key]
+	if !found {
+		return false
+	}
+	delete(r.items, key)
+	return time.Since(stopped) <= MonitorRestartWindow
+}
+
+var recentStops = new(TRecentStops)
+
+// countMonitorRestart counts a new monitor of a container monitored shortly before.
+// The name label matches the one of the container metrics, see -name-label.
+func countMonitorRestart(host string, name string, dockerLabels map[string]string) {
+	if monitorRestartsVec == nil || !recentStops.Restarted(host, name) {
+		return
+	}
+	labels := hostLabels(host)
+	labels["name"] = metricContainerName(name, dockerLabels)
+	monitorRestartsVec.With(labels).Inc()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/docker/docker/api/types"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ID of the container the exporter runs in, or a prefix of it, see -exclude-self.
+// Empty when not running in a container or it could not be detected.
+var selfContainerId string
+
+// Full container IDs in cgroup paths and mounts, e.g. /docker/<id> of cgroup v1
+// or /var/lib/docker/containers/<id>/hostname mounted into every container
+var containerIdRegex = regexp.MustCompile(`[0-9a-f]{64}`)
+var shortIdRegex = regexp.MustCompile(`^[0-9a-f]{12}$`)
+
+// Mount points of files docker bind mounts from the container directory
+var selfMountPoints = map[string]bool{
+	"/etc/hostname":    true,
+	"/etc/hosts":       true,
+	"/etc/resolv.conf": true,
+}
+
+// detectSelfContainerId returns the ID of the container the exporter runs in.
+// Sources are tried from the most to the least reliable, none of them is
+// present when running on the host, which is no error.
+func detectSelfContainerId() string {
+	// cgroup v1, the container ID is part of the cgroup paths
+	if content, err := os.ReadFile("/proc/self/cgroup"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if id := containerIdRegex.FindString(line); id != "" {
+				return id
+			}
+		}
+	}
+
+	// cgroup v2 with a private cgroup namespace, docker mounts files of the container
+	// directory over these. The mount table of the host lists the directories of
+	// other containers too, which are never mounted there.
+	if content, err := os.ReadFile("/proc/self/mountinfo"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 5 || !selfMountPoints[fields[4]] {
+				continue
+			}
+			if id := containerIdRegex.FindString(fields[3]); id != "" {
+				return id
+			}
+		}
+	}
+
+	// Docker sets the host name to the short container ID unless it's configured
+	if hostname, err := os.Hostname(); err == nil && shortIdRegex.MatchString(hostname) {
+		return hostname
+	}
+	return ""
+}
+
+// excludeSelf drops the container the exporter runs in from the list
+func excludeSelf(list []types.Container) []types.Container {
+	if selfContainerId == "" {
+		return list
+	}
+	var res []types.Container
+	for _, cont := range list {
+		if !strings.HasPrefix(cont.ID, selfContainerId) {
+			res = append(res, cont)
+		}
+	}
+	return res
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+const selfTestContainerId = "5e1f7e57c0de5e1f7e57c0de5e1f7e57c0de5e1f7e57c0de5e1f7e57c0de5e1f"
+
+// Canned stats frame served by the fake Docker client
+const selfTestStats = `{
+  "id": "` + selfTestContainerId + `",
+  "name": "/selftest",
+  "read": "2024-01-01T00:00:01Z",
+  "preread": "2024-01-01T00:00:00Z",
+  "pids_stats": {"current": 3, "limit": 100},
+  "cpu_stats": {
+    "cpu_usage": {"total_usage": 2000000000, "percpu_usage": [1000000000, 1000000000]},
+    "system_cpu_usage": 20000000000,
+    "online_cpus": 2
+  },
+  "precpu_stats": {
+    "cpu_usage": {"total_usage": 1000000000, "percpu_usage": [500000000, 500000000]},
+    "system_cpu_usage": 10000000000,
+    "online_cpus": 2
+  },
+  "memory_stats": {"usage": 104857600, "limit": 536870912, "stats": {"cache": 4857600, "total_inactive_file": 4857600}},
+  "networks": {"eth0": {"rx_bytes": 1024, "tx_bytes": 2048}}
+}
+`
+
+// selfTestChecks returns the metric families the self-test expects with their
+// values for the canned container (NaN: any value). Only the families of the
+// configured metric groups, CPU unit and state metrics are expected.
+func selfTestChecks() map[string]float64 {
+	checks := map[string]float64{
+		"docker_stats_container_monitored_since_seconds": math.NaN(),
+		"docker_stats_container_state_duration_seconds":  math.NaN(),
+	}
+	if memUsageVec != nil {
+		checks["docker_stats_container_memory_usage"] = 104857600
+		checks["docker_stats_container_memory_limit"] = 536870912
+	}
+	if memWorkingSetVec != nil {
+		checks["docker_stats_container_memory_working_set"] = 100000000
+	}
+	if cpuUsageTotalVec != nil {
+		checks["docker_stats_container_cpu_total"] = 2000000000
+		checks["docker_stats_container_cpu_usage_total"] = 2000000000
+	}
+	if cpuPercentage != nil {
+		checks["docker_stats_container_cpu_pcnt"] = 20
+	}
+	if cpuCoresVec != nil {
+		checks["docker_stats_container_cpu_cores"] = 1
+	}
+	if cpuPerCoreVec != nil {
+		checks["docker_stats_container_cpu_per_core"] = 1000000000
+	}
+	if pidsCurrentVec != nil {
+		checks["docker_stats_container_pids_current"] = 3
+		checks["docker_stats_container_pids_limit"] = 100
+	}
+	if networkRxBytesVec != nil {
+		checks["docker_stats_container_network_rx_bytes"] = 1024
+		checks["docker_stats_container_network_tx_bytes"] = 2048
+		checks["docker_stats_container_network_rx_bytes_total"] = 1024
+		checks["docker_stats_container_network_tx_bytes_total"] = 2048
+	}
+	if runningStats != nil {
+		checks["docker_stats_container_running_stats"] = 1
+	}
+	if containerStateVec != nil {
+		checks["docker_stats_container_state"] = math.NaN()
+	}
+	return checks
+}
+
+// TFakeDockerClient serves a canned container and stats stream from memory
+type TFakeDockerClient struct {
+	Container types.ContainerJSON
+	Stats     string
+}
+
+func (c *TFakeDockerClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	if containerID != c.Container.ID {
+		return types.ContainerJSON{}, errors.New(fmt.Sprintf("no such container: %s", containerID))
+	}
+	return c.Container, nil
+}
+
+func (c *TFakeDockerClient) ContainerInspectWithRaw(ctx context.Context, containerID string, getSize bool) (types.ContainerJSON, []byte, error) {
+	containerInspect, err := c.ContainerInspect(ctx, containerID)
+	return containerInspect, nil, err
+}
+
+func (c *TFakeDockerClient) ContainerStats(ctx context.Context, containerID string, stream bool) (types.ContainerStats, error) {
+	if containerID != c.Container.ID {
+		return types.ContainerStats{}, errors.New(fmt.Sprintf("no such container: %s", containerID))
+	}
+
+	// The daemon writes one compact frame per line
+	frame := new(bytes.Buffer)
+	if err := json.Compact(frame, []byte(c.Stats)); err != nil {
+		return types.ContainerStats{}, err
+	}
+	frame.WriteByte('\n')
+
+	// Keep the stream open after the canned frame, like a live container would
+	reader, writer := io.Pipe()
+	go func() {
+		_, _ = writer.Write(frame.Bytes())
+	}()
+	return types.ContainerStats{Body: reader, OSType: "linux"}, nil
+}
+
+// metricValue returns the value of a gauge or counter
+func metricValue(metric *dto.Metric) float64 {
+	if metric.Counter != nil {
+		return metric.GetCounter().GetValue()
+	}
+	return metric.GetGauge().GetValue()
+}
+
+// runSelfTest runs the monitoring pipeline against a fake Docker client and
+// verifies the emitted metrics. Returns the process exit code.
+func runSelfTest() int {
+	fake := &TFakeDockerClient{
+		Container: types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:         selfTestContainerId,
+				Name:       "/selftest",
+				State:      &types.ContainerState{Status: "running", Running: true},
+				HostConfig: &container.HostConfig{},
+			},
+			Config: &container.Config{Labels: map[string]string{}},
+		},
+		Stats: selfTestStats,
+	}
+	// The container vectors are only registered and filled by the monitors in stream mode
+	pullMode = false
+	registry = prometheus.NewRegistry()
+	statsThreads = new(ThreadList)
+	scrapeLabels = getLabels(false)
+	initMetrics()
+
+	read := make(chan struct{})
+	var once sync.Once
+
+	mon := new(TContainerMonitor)
+	mon.Id = selfTestContainerId
+	mon.Cli = fake
+	mon.OnStatRead = func(stat *TContainerStatistic) {
+		containerStatisticRead(stat)
+		once.Do(func() { close(read) })
+	}
+	mon.OnRemove = new(TDockerEndpoint).containerStopped
+
+	if er := mon.Exec(); er != nil {
+		fmt.Println("FAIL: can not start container monitor:", er)
+		return 1
+	}
+	_ = statsThreads.Put(mon.Id, mon)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = statsThreads.StopAll(ctx)
+	}()
+
+	select {
+	case <-read:
+	case <-time.After(10 * time.Second):
+		fmt.Println("FAIL: no statistic read from the fake container")
+		return 1
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		fmt.Println("FAIL: can not gather metrics:", err)
+		return 1
+	}
+	values := make(map[string]*dto.Metric)
+	for _, family := range families {
+		if metrics := family.GetMetric(); len(metrics) > 0 {
+			values[family.GetName()] = metrics[0]
+		}
+	}
+
+	checks := selfTestChecks()
+	failed := 0
+	for name, expected := range checks {
+		metric, found := values[name]
+		switch {
+		case !found:
+			fmt.Println("FAIL:", name, "is not populated")
+			failed++
+		case !math.IsNaN(expected) && math.Abs(metricValue(metric)-expected) > 1e-9:
+			fmt.Println("FAIL:", name, "=", metricValue(metric), "expected", expected)
+			failed++
+		default:
+			fmt.Println("OK:  ", name)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Println("Self-test failed:", failed, "of", len(checks), "checks")
+		return 1
+	}
+	fmt.Println("Self-test passed")
+	return 0
+}
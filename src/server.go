@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// newClientAuthTLSConfig returns TLS configuration requiring client certificates signed by the CA file
+func newClientAuthTLSConfig(caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(fmt.Sprintf("no PEM certificates found in %s", caFile))
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// validateListenAddress checks an address given as host:port, an empty address
+// is valid and means the -port form is used
+func validateListenAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if number, err := strconv.Atoi(port); err != nil || number <= 0 || number > 65535 {
+		return errors.New(fmt.Sprintf("port %q must be between 1 and 65535", port))
+	}
+	return nil
+}
+
+// First file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+const systemdListenFdsStart = 3
+
+// systemdListener returns the listener passed by systemd socket activation, nil
+// when the process was not socket activated. The environment is cleared, so
+// child processes don't take the socket for theirs.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds > 1 {
+		slog.Warn("Several sockets passed by systemd, serving metrics on the first one", "count", fds)
+	}
+	file := os.NewFile(uintptr(systemdListenFdsStart), "LISTEN_FD_3")
+	defer file.Close() // FileListener works on a duplicate
+	return net.FileListener(file)
+}
+
+// listenMetrics opens the listener of the metrics server: the socket passed by
+// systemd when socket activated, the unix socket when a path is given, the TCP
+// address otherwise. A stale socket left by a previous run is removed; the
+// socket file is removed again when the server shuts down.
+func listenMetrics(addr string, socketPath string) (net.Listener, error) {
+	if listener, err := systemdListener(); listener != nil || err != nil {
+		return listener, err
+	}
+
+	if socketPath == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(fmt.Sprintf("%s exists and is not a socket", socketPath))
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+	return listener, nil
+}
+
+// serveMetrics runs the HTTP server on the listener, over TLS when a certificate
+// is given. Returns nil when the server has been shut down gracefully.
+func serveMetrics(srv *http.Server, listener net.Listener, certFile string, keyFile string) error {
+	var err error
+	if certFile != "" {
+		err = srv.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = srv.Serve(listener)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TStatsSnapshot is the JSON view of the latest statistic of a container
+type TStatsSnapshot struct {
+	Id          string            `json:"id"`
+	Name        string            `json:"name"`
+	Host        string            `json:"host,omitempty"`
+	Labels      map[string]string `json:"labels"`
+	State       string            `json:"state"`
+	CPUPercent  float64           `json:"cpu_pcnt"`
+	MemoryUsage uint64            `json:"memory_usage"`
+	MemoryLimit uint64            `json:"memory_limit"`
+	Read        time.Time         `json:"read"`
+}
+
+// TStatsCache keeps the latest snapshot of every monitored container, keyed by host and ID
+type TStatsCache struct {
+	sync.RWMutex
+	items map[string]TStatsSnapshot
+}
+
+func (c *TStatsCache) Put(stat *TContainerStatistic) {
+	snapshot := TStatsSnapshot{
+		Id:     stat.Id,
+		Name:   normalizeContainerName(stat.Name),
+		Host:   stat.Host,
+		Labels: stat.Labels,
+		State:  stat.RunningState,
+		Read:   time.Now(),
+	}
+	if !stat.StateOnly {
+		if hasCPUDelta(stat) && stat.RunningState != "paused" {
+			snapshot.CPUPercent = calculateCPUPercent(stat)
+		}
+		snapshot.MemoryUsage = stat.MemoryStats.Usage
+		snapshot.MemoryLimit = stat.MemoryStats.Limit
+	}
+
+	c.Lock()
+	if c.items == nil {
+		c.items = make(map[string]TStatsSnapshot)
+	}
+	c.items[stat.Host+"#"+stat.Id] = snapshot
+	c.Unlock()
+}
+
+func (c *TStatsCache) Del(host string, id string) {
+	c.Lock()
+	delete(c.items, host+"#"+id)
+	c.Unlock()
+}
+
+// Clear drops the snapshots of all containers
+func (c *TStatsCache) Clear() {
+	c.Lock()
+	c.items = nil
+	c.Unlock()
+}
+
+// List returns the snapshots ordered by host and container name
+func (c *TStatsCache) List() []TStatsSnapshot {
+	c.RLock()
+	res := make([]TStatsSnapshot, 0, len(c.items))
+	for _, snapshot := range c.items {
+		res = append(res, snapshot)
+	}
+	c.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Host != res[j].Host {
+			return res[i].Host < res[j].Host
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+var statsCache = new(TStatsCache)
+
+// statsJsonHandler serves the latest snapshot of all monitored containers as a JSON array
+func statsJsonHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statsCache.List())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sync"
+	"time"
+)
+
+// TReadTimes holds the time of the last statistic read of every container and
+// the time docker measured it, keyed by the labels identifying its series
+type TReadTimes struct {
+	sync.Mutex
+	items  map[string]time.Time
+	frames map[string]time.Time
+}
+
+// Touch records a statistic read, frameRead is the read time of its stats frame
+// and zero for statistics without one, e.g. of stopped containers
+func (t *TReadTimes) Touch(labels prometheus.Labels, frameRead time.Time) {
+	key := seriesKey(labels["host"], labels["id"], labels["name"])
+
+	t.Lock()
+	if t.items == nil {
+		t.items = make(map[string]time.Time)
+		t.frames = make(map[string]time.Time)
+	}
+	t.items[key] = time.Now()
+	if frameRead.IsZero() {
+		delete(t.frames, key)
+	} else {
+		t.frames[key] = frameRead
+	}
+	t.Unlock()
+}
+
+func (t *TReadTimes) Del(labels prometheus.Labels) {
+	key := seriesKey(labels["host"], labels["id"], labels["name"])
+
+	t.Lock()
+	delete(t.items, key)
+	delete(t.frames, key)
+	t.Unlock()
+}
+
+// Frames returns a copy of the stats frame read times
+func (t *TReadTimes) Frames() map[string]time.Time {
+	t.Lock()
+	defer t.Unlock()
+
+	res := make(map[string]time.Time, len(t.frames))
+	for key, read := range t.frames {
+		res[key] = read
+	}
+	return res
+}
+
+// Stale returns the keys of the containers not read within maxAge
+func (t *TReadTimes) Stale(maxAge time.Duration) map[string]bool {
+	t.Lock()
+	defer t.Unlock()
+
+	res := make(map[string]bool)
+	for key, read := range t.items {
+		if time.Since(read) > maxAge {
+			res[key] = true
+		}
+	}
+	return res
+}
+
+var readTimes = new(TReadTimes)
+
+// TCounterTotals holds the last cumulative value added to a counter of every
+// container, keyed like TReadTimes
+type TCounterTotals struct {
+	sync.Mutex
+	items map[string]map[string]uint64 // values per item, e.g. network interface
+}
+
+// Delta returns the increase of the cumulative value of an item of a container
+// since the last call. A value below the last one was reset, e.g. by a container
+// restart, so all of it counts as the increase.
+func (t *TCounterTotals) Delta(labels prometheus.Labels, item string, total uint64) uint64 {
+	key := seriesKey(labels["host"], labels["id"], labels["name"])
+
+	t.Lock()
+	defer t.Unlock()
+	if t.items == nil {
+		t.items = make(map[string]map[string]uint64)
+	}
+	values := t.items[key]
+	if values == nil {
+		values = make(map[string]uint64)
+		t.items[key] = values
+	}
+	last, found := values[item]
+	values[item] = total
+	if found && total >= last {
+		return total - last
+	}
+	return total
+}
+
+func (t *TCounterTotals) Del(labels prometheus.Labels) {
+	t.Lock()
+	delete(t.items, seriesKey(labels["host"], labels["id"], labels["name"]))
+	t.Unlock()
+}
+
+// Clear forgets all values, when the counters are reset
+func (t *TCounterTotals) Clear() {
+	t.Lock()
+	t.items = nil
+	t.Unlock()
+}
+
+// Last cumulative values added to the container counters, e.g. cpu_usage_total
+var counterTotals = new(TCounterTotals)
+
+// Last cumulative values added to the counters of the compatibility mode, see -compat
+var compatTotals = new(TCounterTotals)
+
+// seriesKey identifies the series of a container
+func seriesKey(host string, id string, name string) string {
+	return host + "\x00" + id + "\x00" + name
+}
+
+// TStaleFilterCollector exposes the container vectors, omitting the series of
+// containers without a statistic read within MaxAge. A stalled stats stream then
+// makes the series go stale in Prometheus instead of freezing their last values.
+// With Timestamps the samples carry the read time of their stats frame instead
+// of the scrape time, see -use-stats-timestamp.
+type TStaleFilterCollector struct {
+	MaxAge     time.Duration // 0 to expose all series
+	Timestamps bool
+}
+
+// Describe sends no descriptors, see TPullCollector.Describe
+func (c *TStaleFilterCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *TStaleFilterCollector) Collect(ch chan<- prometheus.Metric) {
+	var stale map[string]bool
+	if c.MaxAge > 0 {
+		stale = readTimes.Stale(c.MaxAge)
+	}
+	var frames map[string]time.Time
+	if c.Timestamps {
+		frames = readTimes.Frames()
+	}
+
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	for _, vector := range containerVectors {
+		metrics := make(chan prometheus.Metric)
+		go func(vector TContainerVector) {
+			vector.Collect(metrics)
+			close(metrics)
+		}(vector)
+
+		for metric := range metrics {
+			if len(stale) == 0 && len(frames) == 0 {
+				ch <- metric
+				continue
+			}
+			key := metricSeriesKey(metric)
+			if stale[key] {
+				continue
+			}
+			if read, found := frames[key]; found {
+				metric = prometheus.NewMetricWithTimestamp(read, metric)
+			}
+			ch <- metric
+		}
+	}
+}
+
+// metricSeriesKey returns the key of the container a metric belongs to
+func metricSeriesKey(metric prometheus.Metric) string {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return ""
+	}
+
+	var host, id, name string
+	for _, pair := range m.GetLabel() {
+		switch pair.GetName() {
+		case "host":
+			host = pair.GetValue()
+		case "id":
+			id = pair.GetValue()
+		case "name":
+			name = pair.GetValue()
+		}
+	}
+	return seriesKey(host, id, name)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Size of the read buffer of a stats stream, see -stats-buffer-size. Frames
+// are received as they arrive, the buffer only bounds the size of a read.
+var statsBufferSize = DefaultStatsBufferSize
+
+// DefaultStatsBufferSize holds some 20 frames of a container with a few networks
+const DefaultStatsBufferSize = 64 * 1024
+
+// TStatsReader decodes statistic frames from a docker stats stream. Frames are
+// newline delimited, each one is read as a line, so a malformed frame is
+// skipped by just moving on to the next line.
+//
+// The frames are received by a goroutine as the daemon sends them, keeping
+// only the most recent one: the stream body is HTTP chunked and a read returns
+// about one chunk, so reading on the tick only would drain a backlog one frame
+// per tick. The goroutine returns once the stream ends or its body is closed.
+type TStatsReader struct {
+	lock    sync.Mutex
+	latest  []byte        // most recent frame not returned yet
+	err     error         // error which ended the stream
+	changed chan struct{} // signals a received frame or the end of the stream
+}
+
+func newStatsReader(stream io.Reader) *TStatsReader {
+	r := &TStatsReader{changed: make(chan struct{}, 1)}
+	go r.receive(bufio.NewReaderSize(stream, statsBufferSize))
+	return r
+}
+
+// receive reads the frames until the stream ends, discarding the ones not
+// returned by Latest in time
+func (r *TStatsReader) receive(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		r.lock.Lock()
+		if err != nil {
+			r.err = err // a frame cut off by the end of the stream is no frame
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			r.latest = line
+		}
+		r.lock.Unlock()
+
+		select {
+		case r.changed <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Latest blocks until a frame is available, then returns the most recent one
+// received, discarding the intermediates. The error of the most recent frame is
+// returned when it is malformed, the error of the stream once it ended.
+func (r *TStatsReader) Latest() (*TContainerStatistic, error) {
+	for {
+		r.lock.Lock()
+		line, err := r.latest, r.err
+		r.latest = nil
+		r.lock.Unlock()
+
+		if line != nil {
+			statistic := new(TContainerStatistic)
+			if er := json.Unmarshal(line, statistic); er != nil {
+				return nil, er
+			}
+			return statistic, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		<-r.changed
+	}
+}
+
+// IsMalformedFrame reports whether the error is caused by a single bad frame
+// rather than by the stream itself
+func IsMalformedFrame(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// statsFrame returns a stats frame read at the second of the first test minute
+func statsFrame(second int) string {
+	return fmt.Sprintf(`{"read":"2024-01-01T00:00:%02dZ","pids_stats":{"current":1}}`+"\n", second)
+}
+
+func TestStatsReaderLatest(t *testing.T) {
+	// Like the daemon, the server sends every frame as a chunk of the response
+	chunks := make(chan string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case chunk := <-chunks:
+				_, _ = io.WriteString(w, chunk)
+				w.(http.Flusher).Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !slices.Contains(resp.TransferEncoding, "chunked") {
+		t.Fatalf("transfer encoding = %v, expected chunked", resp.TransferEncoding)
+	}
+	reader := newStatsReader(resp.Body)
+
+	// send pushes the chunks and waits until the last whole frame is received
+	send := func(received string, pushed ...string) {
+		t.Helper()
+		for _, chunk := range pushed {
+			chunks <- chunk
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			reader.lock.Lock()
+			latest := string(reader.latest)
+			reader.lock.Unlock()
+			if latest == received {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("frame %q was not received", received)
+	}
+	expectRead := func(second int) {
+		t.Helper()
+		statistic, err := reader.Latest()
+		if err != nil {
+			t.Fatalf("Latest() returned %v, expected the frame of second %d", err, second)
+		}
+		if expected := time.Date(2024, 1, 1, 0, 0, second, 0, time.UTC); !statistic.Read.Equal(expected) {
+			t.Errorf("Latest() read = %v, expected %v", statistic.Read, expected)
+		}
+	}
+
+	// The producer pushes faster than the consumer ticks
+	send(statsFrame(5), statsFrame(1), statsFrame(2), statsFrame(3), statsFrame(4), statsFrame(5))
+	expectRead(5)
+
+	// A malformed frame in between is skipped
+	send(statsFrame(7), statsFrame(6), "{\"read\":\n", statsFrame(7))
+	expectRead(7)
+
+	// A frame still being received is left for the next tick
+	frame := statsFrame(9)
+	send(statsFrame(8), statsFrame(8), frame[:10])
+	expectRead(8)
+	send(frame, frame[10:])
+	expectRead(9)
+
+	// A malformed most recent frame is reported
+	send("{\"read\":\n", statsFrame(10), "{\"read\":\n")
+	if _, err := reader.Latest(); !IsMalformedFrame(err) {
+		t.Errorf("Latest() of a malformed frame returned %v, expected a malformed frame error", err)
+	}
+
+	// The end of the stream is reported once its frames are read
+	send(statsFrame(11), statsFrame(11))
+	_ = resp.Body.Close()
+	expectRead(11)
+	if _, err := reader.Latest(); err == nil {
+		t.Error("Latest() of a closed stream returned no error")
+	}
+}
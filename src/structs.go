@@ -1,34 +1,106 @@
 package main
 
 import (
+	"context"
 	"github.com/docker/docker/api/types"
 	"time"
 )
 
 type TContainerStatistic struct {
-	Id           string                        `json:"id"`
-	Name         string                        `json:"name"`
-	Read         time.Time                     `json:"read"`
-	PreRead      time.Time                     `json:"preread"`
-	NumProcs     uint                          `json:"num_procs"`
-	PidsStats    types.PidsStats               `json:"pids_stats"`
-	BlkioStats   types.BlkioStats              `json:"blkio_stats"`
-	StorageStats types.StorageStats            `json:"storage_stats"`
-	CPUStats     types.CPUStats                `json:"cpu_stats"`
-	CPUStatsPre  types.CPUStats                `json:"precpu_stats"`
-	MemoryStats  types.MemoryStats             `json:"memory_stats"`
-	Networks     map[string]types.NetworkStats `json:"networks"`
+	Id           string                   `json:"id"`
+	Name         string                   `json:"name"`
+	Read         time.Time                `json:"read"`
+	PreRead      time.Time                `json:"preread"`
+	NumProcs     uint                     `json:"num_procs"`
+	PidsStats    TPidsStats               `json:"pids_stats"`
+	BlkioStats   TBlkioStats              `json:"blkio_stats"`
+	CPUStats     TCPUStats                `json:"cpu_stats"`
+	CPUStatsPre  TCPUStats                `json:"precpu_stats"`
+	MemoryStats  TMemoryStats             `json:"memory_stats"`
+	Networks     map[string]TNetworkStats `json:"networks"`
 	Labels       map[string]string
 	RunningState string `json:"running_state"`
+
+	Host           string              // docker host label of the container, empty for a single daemon
+	Platform       string              // OS of the container: linux or windows
+	CgroupVersion  string              // cgroup version of the container (1, 2), empty when unknown
+	MonitoredSince time.Time           // time the container monitor has been started
+	StateSince     time.Time           // time the container entered RunningState
+	Inspect        types.ContainerJSON // container inspect result for this read
+	StartupSeconds float64             // time from creation until the container was started, 0 when unknown
+	SizeRw         *int64              // size of the writable layer, nil unless -fs-size-interval is set
+	SizeRootFs     *int64              // size of all container files, nil unless -fs-size-interval is set
+	StateOnly      bool                // no resource usage available, the container is not running
+}
+
+// Parts of the Docker stats API response. Only the consumed fields are declared,
+// with explicit json tags, so upgrading the Docker SDK can't silently change them.
+
+type TPidsStats struct {
+	Current uint64 `json:"current"`
+	Limit   uint64 `json:"limit"`
+}
+
+type TBlkioStatEntry struct {
+	Major uint64 `json:"major"`
+	Minor uint64 `json:"minor"`
+	Op    string `json:"op"`
+	Value uint64 `json:"value"`
+}
+
+type TBlkioStats struct {
+	IoServiceBytesRecursive []TBlkioStatEntry `json:"io_service_bytes_recursive"`
+}
+
+type TCPUUsage struct {
+	TotalUsage  uint64   `json:"total_usage"`  // nanoseconds, 100ns intervals on Windows
+	PercpuUsage []uint64 `json:"percpu_usage"` // not reported on cgroup v2
+}
+
+type TThrottlingData struct {
+	Periods          uint64 `json:"periods"`
+	ThrottledPeriods uint64 `json:"throttled_periods"`
+	ThrottledTime    uint64 `json:"throttled_time"`
+}
+
+type TCPUStats struct {
+	CPUUsage       TCPUUsage       `json:"cpu_usage"`
+	SystemUsage    uint64          `json:"system_cpu_usage"`
+	OnlineCPUs     uint32          `json:"online_cpus"`
+	ThrottlingData TThrottlingData `json:"throttling_data"`
+}
+
+type TMemoryStats struct {
+	Usage uint64            `json:"usage"`
+	Limit uint64            `json:"limit"`
+	Stats map[string]uint64 `json:"stats"` // cgroup specific counters, e.g. cache or inactive_file
+}
+
+type TNetworkStats struct {
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxErrors  uint64 `json:"rx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxErrors  uint64 `json:"tx_errors"`
+	TxDropped uint64 `json:"tx_dropped"`
 }
 
 type TClbOnStatistic func(stat *TContainerStatistic)
 type TClbOnRemove func(id string)
+type TClbOnStateChange func(stat *TContainerStatistic, prevState string)
+
+// TDockerClient is the subset of the Docker API client used by container monitors
+type TDockerClient interface {
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerInspectWithRaw(ctx context.Context, containerID string, getSize bool) (types.ContainerJSON, []byte, error)
+	ContainerStats(ctx context.Context, containerID string, stream bool) (types.ContainerStats, error)
+}
 
 // 定义了线程应有的基本操作，如执行、停止、设置选项、获取选项
 type TThread interface {
 	Exec() error
 	Stop() error
+	Done() <-chan struct{} // closed once the thread has finished after Stop
 
 	SetOpt(opt TOpt) error
 	GetOpt(name string) *TOpt
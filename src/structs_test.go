@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// Decodes a stats frame of a cgroup v2 container in the format streamed by Docker 26
+func TestDecodeStatistic(t *testing.T) {
+	payload, err := os.ReadFile("testdata/stats_cgroup_v2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat := new(TContainerStatistic)
+	if err := json.Unmarshal(payload, stat); err != nil {
+		t.Fatalf("can not decode the stats frame: %v", err)
+	}
+
+	if stat.Id != "7c1d2b6f3e5a49f08a6c0d2e4b1f3a5c7e9d0b2a4c6e8f1a3b5d7f9e0c2a4b6d" || stat.Name != "/web-1" {
+		t.Errorf("id, name = %q, %q", stat.Id, stat.Name)
+	}
+	if expected := time.Date(2024, 5, 14, 9, 21, 37, 284377563, time.UTC); !stat.Read.Equal(expected) {
+		t.Errorf("read = %v, expected %v", stat.Read, expected)
+	}
+	if expected := time.Date(2024, 5, 14, 9, 21, 36, 281039208, time.UTC); !stat.PreRead.Equal(expected) {
+		t.Errorf("preread = %v, expected %v", stat.PreRead, expected)
+	}
+	if stat.PidsStats.Current != 12 {
+		t.Errorf("pids current = %d, expected 12", stat.PidsStats.Current)
+	}
+
+	if stat.CPUStats.CPUUsage.TotalUsage != 1861094000 || stat.CPUStatsPre.CPUUsage.TotalUsage != 1859786000 {
+		t.Errorf("cpu total usage = %d, previous %d", stat.CPUStats.CPUUsage.TotalUsage, stat.CPUStatsPre.CPUUsage.TotalUsage)
+	}
+	if stat.CPUStats.SystemUsage != 1217498530000000 || stat.CPUStatsPre.SystemUsage != 1217490510000000 {
+		t.Errorf("system usage = %d, previous %d", stat.CPUStats.SystemUsage, stat.CPUStatsPre.SystemUsage)
+	}
+	if stat.CPUStats.OnlineCPUs != 8 || len(stat.CPUStats.CPUUsage.PercpuUsage) != 0 {
+		t.Errorf("online cpus = %d, per cpu usages %d", stat.CPUStats.OnlineCPUs, len(stat.CPUStats.CPUUsage.PercpuUsage))
+	}
+
+	if stat.MemoryStats.Usage != 45912064 || stat.MemoryStats.Limit != 16523509760 {
+		t.Errorf("memory usage, limit = %d, %d", stat.MemoryStats.Usage, stat.MemoryStats.Limit)
+	}
+	if stat.MemoryStats.Stats["inactive_file"] != 4386816 {
+		t.Errorf("inactive_file = %d, expected 4386816", stat.MemoryStats.Stats["inactive_file"])
+	}
+	if version := detectCgroupVersion(stat); version != "2" {
+		t.Errorf("detectCgroupVersion() = %q, expected 2", version)
+	}
+
+	if eth0, found := stat.Networks["eth0"]; !found || eth0.RxBytes != 1656 || eth0.TxBytes != 0 {
+		t.Errorf("eth0 = %+v, found %v", eth0, found)
+	}
+	if read, write := sumBlkioBytes(stat, "read"), sumBlkioBytes(stat, "write"); read != 23789568 || write != 4096 {
+		t.Errorf("blkio read, write = %d, %d", read, write)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeTextfile writes the gathered metrics to the file in the text exposition
+// format of the node exporter textfile collector. The file is replaced
+// atomically, so the collector never reads a partially written file.
+func writeTextfile(gatherer prometheus.Gatherer, path string) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		if len(families) == 0 {
+			return err
+		}
+		slog.Warn("Error gathering some metrics for the textfile", "err", err)
+	}
+
+	// The temporary file is created next to the target, a rename across file systems isn't atomic
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(tmp, family); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runTextfileOutput writes the metrics to the file every interval until ctx is
+// cancelled, starting once the first monitoring cycle completed
+func runTextfileOutput(ctx context.Context, gatherer prometheus.Gatherer, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !metricsReady.Load() {
+			continue
+		}
+		if err := writeTextfile(gatherer, path); err != nil {
+			slog.Error("Error writing metrics textfile", "path", path, "err", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TWebhookEvent is the payload posted to the webhook on container state change
+type TWebhookEvent struct {
+	Id        string            `json:"id"`
+	Name      string            `json:"name"`
+	State     string            `json:"state"`
+	PrevState string            `json:"previous_state"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+// TWebhookNotifier delivers state change events to an HTTP endpoint.
+// Events are buffered in a bounded queue; when the queue is full new events
+// are dropped so a slow receiver never blocks container monitors.
+type TWebhookNotifier struct {
+	Url       string
+	QueueSize int
+
+	Dropped prometheus.Counter // incremented for every dropped event (optional)
+
+	// The queue is never closed, monitors still running after Stop may notify
+	queue    chan TWebhookEvent
+	done     chan struct{}
+	stopOnce sync.Once
+	client   *http.Client
+}
+
+func (n *TWebhookNotifier) Exec() error {
+	if n.Url == "" {
+		return errors.New("configuration error: webhook URL must be set")
+	}
+	if n.QueueSize <= 0 {
+		return errors.New("configuration error: webhook queue size must be positive")
+	}
+
+	n.queue = make(chan TWebhookEvent, n.QueueSize)
+	n.done = make(chan struct{})
+	n.client = &http.Client{Timeout: 10 * time.Second}
+	go n.deliver()
+
+	return nil
+}
+
+func (n *TWebhookNotifier) Stop() error {
+	if n.done != nil {
+		n.stopOnce.Do(func() { close(n.done) })
+	}
+	return nil
+}
+
+// Notify enqueues an event without blocking, events after Stop are dropped
+func (n *TWebhookNotifier) Notify(event TWebhookEvent) {
+	select {
+	case <-n.done:
+		return
+	default:
+	}
+
+	select {
+	case n.queue <- event:
+	default:
+		if n.Dropped != nil {
+			n.Dropped.Inc()
+		}
+		slog.Warn("Webhook queue is full, dropping event", "container", event.Name)
+	}
+}
+
+// deliver posts the queued events until Stop, then the ones still queued
+func (n *TWebhookNotifier) deliver() {
+	for {
+		select {
+		case event := <-n.queue:
+			n.send(event)
+		case <-n.done:
+			for {
+				select {
+				case event := <-n.queue:
+					n.send(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (n *TWebhookNotifier) send(event TWebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding webhook event", "err", err)
+		return
+	}
+
+	resp, err := n.client.Post(n.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Error sending webhook event", "err", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		slog.Warn("Webhook receiver responded with error status", "status", resp.Status)
+	}
+}